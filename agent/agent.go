@@ -2,38 +2,280 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"sort"
 	"sync"
+
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
 )
 
+const staticSource = "static"
+
 type Options struct {
-	ScrapeTargets []ScrapeOptions
+	Docker               *metricus.DockerService
+	Storage              *TSDB
+	ScrapeTargets        []ScrapeOptions
+	Discoverers          []Discoverer
+	SubscriberBufferSize int
+	// TargetRelabelConfigs rewrite or drop discovered targets, including the
+	// static ones, before they are scraped
+	TargetRelabelConfigs []*RelabelConfig
+	// MetricRelabelConfigs rewrite or drop samples after every scrape
+	MetricRelabelConfigs []*RelabelConfig
+	// RuleGroups are evaluated against Storage, they must be compiled
+	RuleGroups []*RuleGroupConfig
+	// Notifier receives the alert notifications batched according to Route
+	Notifier Notifier
+	Route    RouteConfig
+	// Silences mute alert notifications, nil keeps them in memory
+	Silences *Silences
+	// ContainerStatsIntervalSeconds is how often docker stats of running
+	// containers are stored
+	ContainerStatsIntervalSeconds int
+	// Control enables the container control endpoints
+	Control ControlConfig
+	// Audit records container control actions, nil keeps them in memory
+	Audit *AuditLog
+	// Logs stores the logs of the containers selected by LogCollection, nil
+	// disables log collection
+	Logs          *LogStore
+	LogCollection LogCollectorOptions
+	// LogMetrics turn collected log lines into series of Storage, they must
+	// be compiled
+	LogMetrics []*LogMetricConfig
 }
 
 type Agent struct {
 	Options Options
+
+	// Hub receives the relabeled samples of every successful scrape
+	Hub *Hub
+	// Rules is nil when storage is disabled
+	Rules    *RuleManager
+	Silences *Silences
+	Audit    *AuditLog
+	// Events is nil when docker is not available
+	Events *DockerEvents
+
+	dispatcher *Dispatcher
+
+	mu       sync.Mutex
+	ctx      context.Context
+	wg       sync.WaitGroup
+	groups   map[string][]ScrapeOptions
+	scrapers map[string]*activeScraper
+}
+
+type activeScraper struct {
+	opts    ScrapeOptions
+	scraper *Scraper
+	cancel  context.CancelFunc
 }
 
 func New(opts Options) *Agent {
-	return &Agent{
-		Options: opts,
+	a := &Agent{
+		Options:  opts,
+		Hub:      NewHub(opts.SubscriberBufferSize),
+		groups:   make(map[string][]ScrapeOptions),
+		scrapers: make(map[string]*activeScraper),
 	}
+
+	if opts.Docker != nil {
+		a.Events = NewDockerEvents(opts.Docker, DefaultEventBacklog)
+	}
+
+	a.Audit = opts.Audit
+	if a.Audit == nil {
+		a.Audit, _ = OpenAuditLog("")
+	}
+
+	a.Silences = opts.Silences
+	if a.Silences == nil {
+		a.Silences, _ = OpenSilences("")
+	}
+
+	if opts.Storage != nil {
+		var notifier Notifier
+		if opts.Notifier != nil {
+			a.dispatcher = NewDispatcher(opts.Route, a.Silences, opts.Notifier)
+			notifier = a.dispatcher
+		}
+
+		a.Rules = NewRuleManager(RuleManagerOptions{
+			Groups:    opts.RuleGroups,
+			Queryable: opts.Storage,
+			Notifier:  notifier,
+			Appender:  opts.Storage,
+			Hub:       a.Hub,
+		})
+	}
+
+	return a
 }
 
-func (a *Agent) Start() {
-	var wg sync.WaitGroup
-	for _, target := range a.Options.ScrapeTargets {
-		wg.Add(1)
-		go func(target ScrapeOptions) {
-			defer wg.Done()
+// Start runs the static targets and every discoverer until ctx is cancelled
+func (a *Agent) Start(ctx context.Context) {
+	a.mu.Lock()
+	a.ctx = ctx
+	a.mu.Unlock()
+
+	a.SyncTargets(staticSource, a.Options.ScrapeTargets)
+
+	if a.Events != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.Events.Run(ctx)
+		}()
+	}
+
+	if a.dispatcher != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.dispatcher.Run(ctx)
+		}()
+	}
+
+	if a.Rules != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.Rules.Run(ctx)
+		}()
+	}
+
+	if a.Options.Docker != nil && a.Options.Storage != nil {
+		collector := NewContainerStatsCollector(a.Options.Docker, a.Options.Storage, ContainerStatsOptions{
+			IntervalSeconds: a.Options.ContainerStatsIntervalSeconds,
+		})
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			collector.Run(ctx)
+		}()
+	}
+
+	var logMetrics *LogMetrics
+	if a.Options.Storage != nil && len(a.Options.LogMetrics) > 0 {
+		logMetrics = NewLogMetrics(a.Options.LogMetrics, a.Options.Storage)
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			logMetrics.Run(ctx)
+		}()
+	}
+
+	if a.Options.Docker != nil && (a.Options.Logs != nil || logMetrics != nil) {
+		collector := NewLogCollector(a.Options.Docker, a.Options.Logs, logMetrics, a.Options.LogCollection)
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			collector.Run(ctx)
+		}()
+	}
+
+	for _, discoverer := range a.Options.Discoverers {
+		a.wg.Add(1)
+		go func(d Discoverer) {
+			defer a.wg.Done()
 
-			scraper := NewScraper(ScrapeOptions{
-				Host:            target.Host,
-				IntervalSeconds: target.IntervalSeconds,
-				Channel:         target.Channel,
+			err := d.Run(ctx, func(targets []ScrapeOptions) {
+				a.SyncTargets(d.Name(), targets)
 			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Error().Err(err).Str("discoverer", d.Name()).Msg("discovery stopped")
+			}
+		}(discoverer)
+	}
+
+	<-ctx.Done()
+	a.wg.Wait()
+}
 
-			scraper.Scrape(context.Background())
-		}(target)
+// SyncTargets replaces the targets known from source and starts or stops
+// scrapers so that the running set matches the union of all sources
+func (a *Agent) SyncTargets(source string, targets []ScrapeOptions) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.groups[source] = targets
+	a.reconcile()
+}
+
+// reconcile must be called with a.mu held
+func (a *Agent) reconcile() {
+	if a.ctx == nil {
+		return
 	}
-	wg.Wait()
+
+	sources := make([]string, 0, len(a.groups))
+	for source := range a.groups {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	// when two sources report the same endpoint the first source wins
+	desired := make(map[string]ScrapeOptions)
+	for _, source := range sources {
+		for _, target := range a.groups[source] {
+			target, keep := relabelTarget(target, source, a.Options.TargetRelabelConfigs)
+			if !keep {
+				continue
+			}
+			target.MetricRelabelConfigs = a.Options.MetricRelabelConfigs
+
+			if _, ok := desired[target.URL()]; !ok {
+				desired[target.URL()] = target
+			}
+		}
+	}
+
+	for key, active := range a.scrapers {
+		if target, ok := desired[key]; ok && reflect.DeepEqual(target, active.opts) {
+			continue
+		}
+
+		active.cancel()
+		delete(a.scrapers, key)
+		log.Info().Str("target", key).Msg("stopped scraping target")
+	}
+
+	for key, target := range desired {
+		if _, ok := a.scrapers[key]; ok {
+			continue
+		}
+
+		opts := target
+		opts.Hub = a.Hub
+		if a.Options.Storage != nil {
+			opts.Appender = a.Options.Storage
+		}
+		ctx, cancel := context.WithCancel(a.ctx)
+		scraper := NewScraper(opts)
+		a.scrapers[key] = &activeScraper{opts: target, scraper: scraper, cancel: cancel}
+
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			scraper.Scrape(ctx)
+		}()
+		log.Info().Str("target", key).Msg("started scraping target")
+	}
+}
+
+// Targets returns the status of every active scrape target
+func (a *Agent) Targets() []TargetStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	targets := make([]TargetStatus, 0, len(a.scrapers))
+	for _, active := range a.scrapers {
+		targets = append(targets, active.scraper.Status())
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].URL < targets[j].URL })
+
+	return targets
 }
@@ -1,11 +1,16 @@
 package agent
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	metricus "github.com/jordanlumley/metricus/sdk"
-
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
@@ -21,7 +26,7 @@ func init() {
 	// log.Logger = log.Output(output)
 }
 
-func StartAPI() {
+func StartAPI(ctx context.Context, a *Agent) {
 	e := echo.New()
 	e.HideBanner = true
 
@@ -46,10 +51,7 @@ func StartAPI() {
 		},
 	}))
 
-	dockerService, err := metricus.NewDockerService()
-	if err != nil {
-		log.Fatal().Err(err).Msg("error creating docker service")
-	}
+	dockerService := a.Options.Docker
 
 	e.GET("/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "OK")
@@ -59,36 +61,249 @@ func StartAPI() {
 	v1.GET("/metrics/events", func(c echo.Context) error {
 		UpgradeSSE(c.Response())
 
-		metricsStream := make(chan []byte)
+		sub := a.Hub.Subscribe()
+		defer sub.Close()
+
 		ctx := c.Request().Context()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case message, ok := <-sub.C:
+				if !ok {
+					return nil
+				}
 
-		go func() {
-			defer close(metricsStream)
-
-			// start scraping the metrics endpoint every 10 seconds
-			agent := New(Options{
-				ScrapeTargets: []ScrapeOptions{
-					{
-						Host:            "http://example_client:8080",
-						IntervalSeconds: 2,
-						Channel:         metricsStream,
-					},
-				},
-			})
-			agent.Start()
-		}()
+				if err := SendSSE(c.Response(), message); err != nil {
+					log.Error().Err(err).Msg("error sending metricsStream message")
+					return err
+				}
+			}
+		}
+	})
+
+	v1.GET("/metrics", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		value, err := NewEngine(storage).Instant(`{__name__!=""}`, time.Now())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error reading metrics")
+		}
+
+		vector := value.(Vector)
+		metrics := make(map[string]float64, len(vector))
+		for _, sample := range vector {
+			metrics[sample.Metric.String()] = sample.Point.V
+		}
+
+		return c.JSON(http.StatusOK, metrics)
+	})
+
+	v1.GET("/query", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		ts, err := parseTimeParam(c.QueryParam("time"), time.Now())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		value, err := NewEngine(storage).Instant(c.QueryParam("query"), ts)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, QueryResult{ResultType: value.Type(), Result: value})
+	})
+
+	v1.GET("/query_range", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		start, end, step, err := parseRangeParams(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		matrix, err := NewEngine(storage).Range(c.QueryParam("query"), start, end, step)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, QueryResult{ResultType: matrix.Type(), Result: matrix})
+	})
+
+	v1.GET("/series", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		end, err := parseTimeParam(c.QueryParam("end"), time.Now())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		start, err := parseTimeParam(c.QueryParam("start"), end.Add(-LookbackDelta))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		selectors := c.QueryParams()["match[]"]
+		if len(selectors) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "at least one match[] selector is required")
+		}
+
+		seen := make(map[uint64]struct{})
+		result := []Labels{}
+		for _, selector := range selectors {
+			matchers, err := ParseSelector(selector)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
 
+			series, err := storage.Select(start.UnixMilli(), end.UnixMilli(), matchers...)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "error listing series")
+			}
+			for _, s := range series {
+				if _, ok := seen[s.Labels.Hash()]; !ok {
+					seen[s.Labels.Hash()] = struct{}{}
+					result = append(result, s.Labels)
+				}
+			}
+		}
+
+		return c.JSON(http.StatusOK, result)
+	})
+
+	v1.GET("/labels", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, storage.LabelNames())
+	})
+
+	v1.GET("/label/:name/values", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		var matchers []*Matcher
+		for _, selector := range c.QueryParams()["match[]"] {
+			selected, err := ParseSelector(selector)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			matchers = append(matchers, selected...)
+		}
+
+		return c.JSON(http.StatusOK, storage.LabelValues(c.Param("name"), matchers...))
+	})
+
+	v1.GET("/targets", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, a.Targets())
+	})
+
+	v1.GET("/alerts", func(c echo.Context) error {
+		alerts := []Alert{}
+		if a.Rules != nil {
+			alerts = append(alerts, a.Rules.Alerts()...)
+		}
+		for i := range alerts {
+			alerts[i].SilencedBy = a.Silences.Mutes(alerts[i].Labels)
+		}
+
+		return c.JSON(http.StatusOK, alerts)
+	})
+
+	v1.GET("/silences", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, a.Silences.List())
+	})
+
+	v1.POST("/silences", func(c echo.Context) error {
+		var silence Silence
+		if err := c.Bind(&silence); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid silence")
+		}
+
+		id, err := a.Silences.Set(silence)
+		if errors.Is(err, ErrSilenceNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"silenceId": id})
+	})
+
+	v1.DELETE("/silences/:id", func(c echo.Context) error {
+		err := a.Silences.Expire(c.Param("id"))
+		if errors.Is(err, ErrSilenceNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error expiring silence")
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+
+	v1.GET("/events", func(c echo.Context) error {
+		if a.Events == nil {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "docker events are not available")
+		}
+
+		filter := EventFilter{
+			Types:   queryList(c, "type"),
+			Actions: queryList(c, "action"),
+		}
+		backlog, sub := a.Events.Subscribe()
+		defer sub.Close()
+
+		UpgradeSSE(c.Response())
+
+		if c.QueryParam("backlog") != "false" {
+			for _, event := range backlog {
+				if !filter.Matches(event) {
+					continue
+				}
+				message, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				if err := SendSSE(c.Response(), message); err != nil {
+					return err
+				}
+			}
+		}
+
+		ctx := c.Request().Context()
 		for {
 			select {
 			case <-ctx.Done():
 				return nil
-			case message, ok := <-metricsStream:
+			case message, ok := <-sub.C:
 				if !ok {
 					return nil
 				}
 
+				var event DockerEvent
+				if err := json.Unmarshal(message, &event); err != nil || !filter.Matches(event) {
+					continue
+				}
 				if err := SendSSE(c.Response(), message); err != nil {
-					log.Error().Err(err).Msg("error sending metricsStream message")
+					log.Error().Err(err).Msg("error sending event message")
 					return err
 				}
 			}
@@ -96,7 +311,7 @@ func StartAPI() {
 	})
 
 	v1.GET("/containers", func(c echo.Context) error {
-		containers, err := dockerService.GetContainers(c.Request().Context())
+		containers, err := dockerService.GetContainers(c.Request().Context(), queryList(c, "label")...)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "error getting containers")
 		}
@@ -104,6 +319,31 @@ func StartAPI() {
 		return c.JSON(http.StatusOK, containers)
 	})
 
+	v1.GET("/containers/groups", func(c echo.Context) error {
+		keys, err := groupLabelKeys(c.QueryParam("by"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		withStats := true
+		if param := c.QueryParam("stats"); param != "" {
+			if withStats, err = strconv.ParseBool(param); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "stats must be true or false")
+			}
+		}
+
+		containers, err := dockerService.GetContainers(c.Request().Context(), queryList(c, "label")...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error getting containers")
+		}
+
+		groups := groupContainers(containers, keys)
+		if withStats {
+			addGroupStats(c.Request().Context(), dockerService, groups)
+		}
+
+		return c.JSON(http.StatusOK, groups)
+	})
+
 	v1.GET("/containers/:containerId", func(c echo.Context) error {
 		containerID := c.Param("containerId")
 		container, err := dockerService.GetContainer(c.Request().Context(), containerID)
@@ -116,7 +356,7 @@ func StartAPI() {
 
 	v1.GET("/containers/:containerId/stats", func(c echo.Context) error {
 		containerID := c.Param("containerId")
-		stats, err := dockerService.GetContainerMetrics(c.Request().Context(), containerID)
+		stats, err := dockerService.GetContainerStats(c.Request().Context(), containerID)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("error getting container(%s)", containerID))
 		}
@@ -124,17 +364,66 @@ func StartAPI() {
 		return c.JSON(http.StatusOK, stats)
 	})
 
+	v1.GET("/containers/:containerId/stats/history", func(c echo.Context) error {
+		storage, err := requireStorage(a)
+		if err != nil {
+			return err
+		}
+
+		to, err := parseTimeParam(c.QueryParam("to"), time.Now())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		from, err := parseTimeParam(c.QueryParam("from"), to.Add(-time.Hour))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if !from.Before(to) {
+			return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+		}
+
+		interval := time.Duration(a.Options.ContainerStatsIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = DefaultContainerStatsIntervalSeconds * time.Second
+		}
+		step := max(to.Sub(from)/defaultHistoryPoints, interval)
+		if value := c.QueryParam("step"); value != "" {
+			if step, err = parseDurationParam(value); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+		if err := validateStep(from, to, step); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		// stats stay queryable after the container is removed, by ID or name
+		containerID := c.Param("containerId")
+		matcher := &Matcher{Type: MatchEqual, Name: ContainerIDLabel, Value: shortID(containerID)}
+		if container, err := dockerService.GetContainer(c.Request().Context(), containerID); err == nil {
+			matcher.Value = shortID(container.ID)
+		} else if !isHexID(containerID) {
+			matcher = &Matcher{Type: MatchEqual, Name: ContainerNameLabel, Value: strings.TrimPrefix(containerID, "/")}
+		}
+
+		history, err := containerStatsHistory(NewEngine(storage), matcher, from, to, step, max(step, 3*interval))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error reading container stats history")
+		}
+
+		return c.JSON(http.StatusOK, history)
+	})
+
 	v1.GET("/containers/:containerId/stats/test", func(c echo.Context) error {
 		containerID := c.Param("containerId")
 
 		UpgradeSSE(c.Response())
 
-		metricsStream := make(chan []byte)
+		statsStream := make(chan metricus.ContainerStats)
 		ctx := c.Request().Context()
 
 		go func() {
-			defer close(metricsStream)
-			if err := dockerService.StreamContainerMetrics(c.Request().Context(), containerID, metricsStream); err != nil {
+			defer close(statsStream)
+			if err := dockerService.StreamContainerStats(ctx, containerID, statsStream); err != nil {
 				log.Error().Err(err).Msg("error streaming metrics")
 			}
 		}()
@@ -143,12 +432,15 @@ func StartAPI() {
 			select {
 			case <-ctx.Done():
 				return nil
-			case message, ok := <-metricsStream:
-				fmt.Println("sending message metrics", containerID)
+			case stats, ok := <-statsStream:
 				if !ok {
 					return nil
 				}
 
+				message, err := json.Marshal(stats)
+				if err != nil {
+					return err
+				}
 				if err := SendSSE(c.Response(), message); err != nil {
 					log.Error().Err(err).Msg("error sending metricsStream message")
 					return err
@@ -157,27 +449,77 @@ func StartAPI() {
 		}
 	})
 
+	control := requireControl(a.Options.Control)
+	for _, action := range []string{"start", "stop", "restart", "pause", "unpause", "kill", "remove"} {
+		v1.POST("/containers/:containerId/"+action, controlContainer(a, action), control)
+	}
+	v1.GET("/containers/:containerId/exec", execContainer(a), control)
+	v1.GET("/audit", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, a.Audit.Entries())
+	}, control)
+
 	v1.GET("/containers/:containerId/logs", func(c echo.Context) error {
 		containerID := c.Param("containerId")
-		logs, err := dockerService.GetLogs(c.Request().Context(), containerID)
+		opts, err := logsOptions(c, DefaultLogTail)
+		if err != nil {
+			return err
+		}
+		filter, err := logFilter(c)
+		if err != nil {
+			return err
+		}
+		// a search looks through all of the logs unless told otherwise
+		if !filter.Empty() && c.QueryParam("tail") == "" {
+			opts.Tail = "all"
+		}
+		limit := DefaultLogMatchLimit
+		if value := c.QueryParam("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+			}
+		}
+
+		// only the most recent matches are kept
+		entries, matched := []LogEntry{}, 0
+		err = dockerService.ScanLogs(c.Request().Context(), containerID, opts, func(line metricus.LogLine) error {
+			entry, ok := filter.Match(line)
+			if !ok {
+				return nil
+			}
+			matched++
+			entries = append(entries, entry)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+			return nil
+		})
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("error getting container(%s) logs", containerID))
 		}
 
-		return c.JSON(http.StatusOK, logs)
+		c.Response().Header().Set("X-Matched-Lines", strconv.Itoa(matched))
+		return c.JSON(http.StatusOK, entries)
 	})
 
 	v1.GET("/containers/:containerId/logs/events", func(c echo.Context) error {
 		containerID := c.Param("containerId")
+		opts, err := logsOptions(c, DefaultStreamLogTail)
+		if err != nil {
+			return err
+		}
+		filter, err := logFilter(c)
+		if err != nil {
+			return err
+		}
 
 		UpgradeSSE(c.Response())
 
-		logStream := make(chan []byte)
+		logStream := make(chan metricus.LogLine)
 		ctx := c.Request().Context()
 
 		go func() {
 			defer close(logStream)
-			if err := dockerService.StreamLogs(c.Request().Context(), containerID, logStream); err != nil {
+			if err := dockerService.StreamLogs(ctx, containerID, opts, logStream); err != nil {
 				log.Error().Err(err).Msg("error streaming logs")
 			}
 		}()
@@ -186,12 +528,19 @@ func StartAPI() {
 			select {
 			case <-ctx.Done():
 				return nil
-			case message, ok := <-logStream:
-				fmt.Println("sending message logs", containerID)
+			case line, ok := <-logStream:
 				if !ok {
 					return nil
 				}
 
+				entry, ok := filter.Match(line)
+				if !ok {
+					continue
+				}
+				message, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
 				if err := SendSSE(c.Response(), message); err != nil {
 					log.Error().Err(err).Msg("error sending logStream message")
 					return err
@@ -200,8 +549,165 @@ func StartAPI() {
 		}
 	})
 
+	v1.GET("/logs", func(c echo.Context) error {
+		store, err := requireLogStore(a)
+		if err != nil {
+			return err
+		}
+
+		to, err := parseTimeParam(c.QueryParam("to"), time.Now())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		from, err := parseTimeParam(c.QueryParam("from"), to.Add(-time.Hour))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if from.After(to) {
+			return echo.NewHTTPError(http.StatusBadRequest, "from must not be after to")
+		}
+		filter, err := logFilter(c)
+		if err != nil {
+			return err
+		}
+		limit := DefaultLogMatchLimit
+		if value := c.QueryParam("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+			}
+		}
+
+		entries, matched, err := store.Query(LogQuery{
+			From:       from,
+			To:         to,
+			Containers: queryList(c, "container"),
+			Filter:     filter,
+			Limit:      limit,
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error querying stored logs")
+		}
+
+		c.Response().Header().Set("X-Matched-Lines", strconv.Itoa(matched))
+		return c.JSON(http.StatusOK, entries)
+	})
+
+	v1.GET("/logs/events", func(c echo.Context) error {
+		opts, err := logsOptions(c, DefaultStreamLogTail)
+		if err != nil {
+			return err
+		}
+		filter, err := logFilter(c)
+		if err != nil {
+			return err
+		}
+
+		labels := queryList(c, "label")
+		if project := c.QueryParam("project"); project != "" {
+			labels = append(labels, ComposeProjectLabel+"="+project)
+		}
+		containers, err := dockerService.GetContainersByLabel(c.Request().Context(), labels...)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error getting containers")
+		}
+		if ids := queryList(c, "container"); len(ids) > 0 {
+			containers = selectContainers(containers, ids)
+		}
+		if len(containers) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "no running container matches")
+		}
+
+		UpgradeSSE(c.Response())
+
+		err = mergeContainerLogs(c.Request().Context(), dockerService, containers, opts, filter, func(entry ContainerLogEntry) error {
+			message, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			return SendSSE(c.Response(), message)
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("error sending merged logs message")
+		}
+
+		return err
+	})
+
+	v1.GET("/logs/containers", func(c echo.Context) error {
+		store, err := requireLogStore(a)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, store.Containers())
+	})
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := e.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("error shutting down api server")
+		}
+	}()
+
 	// Start the server
-	if err = e.Start(":8888"); err != nil {
+	if err := e.Start(":8888"); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal().Err(err).Msg("error starting api server")
 	}
 }
+
+// queryList returns the values of a query parameter given repeatedly or as a
+// comma separated list
+func queryList(c echo.Context, name string) []string {
+	var values []string
+	for _, value := range c.QueryParams()[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+
+	return values
+}
+
+func requireStorage(a *Agent) (*TSDB, error) {
+	if a.Options.Storage == nil {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "metrics storage is disabled")
+	}
+
+	return a.Options.Storage, nil
+}
+
+func requireLogStore(a *Agent) (*LogStore, error) {
+	if a.Options.Logs == nil {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "log collection is disabled")
+	}
+
+	return a.Options.Logs, nil
+}
+
+func parseRangeParams(c echo.Context) (start, end time.Time, step time.Duration, err error) {
+	if start, err = parseTimeParam(c.QueryParam("start"), time.Time{}); err != nil {
+		return
+	}
+	if end, err = parseTimeParam(c.QueryParam("end"), time.Now()); err != nil {
+		return
+	}
+	if start.IsZero() {
+		err = fmt.Errorf("start is required")
+		return
+	}
+	if end.Before(start) {
+		err = fmt.Errorf("end must not be before start")
+		return
+	}
+	if step, err = parseDurationParam(c.QueryParam("step")); err != nil {
+		return
+	}
+	err = validateStep(start, end, step)
+
+	return
+}
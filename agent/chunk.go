@@ -0,0 +1,396 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// xorChunk stores samples with the Gorilla encoding: timestamps as
+// delta-of-deltas and values XORed with their predecessor. The first two
+// bytes hold the number of samples.
+type xorChunk struct {
+	b bstream
+
+	// appender state
+	num      uint16
+	t        int64
+	tDelta   int64
+	v        float64
+	leading  uint8
+	trailing uint8
+	minT     int64
+}
+
+func newXORChunk() *xorChunk {
+	return &xorChunk{b: bstream{stream: make([]byte, 2, 128)}, leading: 0xff}
+}
+
+// loadXORChunk wraps encoded chunk bytes for reading
+func loadXORChunk(data []byte) (*xorChunk, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("chunk too short")
+	}
+
+	return &xorChunk{
+		b:   bstream{stream: data},
+		num: binary.BigEndian.Uint16(data),
+	}, nil
+}
+
+func (c *xorChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+func (c *xorChunk) NumSamples() int {
+	return int(c.num)
+}
+
+func (c *xorChunk) Append(t int64, v float64) {
+	switch c.num {
+	case 0:
+		c.minT = t
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutVarint(buf[:], t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+	case 1:
+		tDelta := t - c.t
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutVarint(buf[:], tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeValue(v)
+		c.tDelta = tDelta
+	default:
+		tDelta := t - c.t
+		dod := tDelta - c.tDelta
+
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0b10, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0b110, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0b1110, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0b1111, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeValue(v)
+		c.tDelta = tDelta
+	}
+
+	c.t = t
+	c.v = v
+	c.num++
+	binary.BigEndian.PutUint16(c.b.stream, c.num)
+}
+
+func (c *xorChunk) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	// the leading count is stored in 5 bits
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// the meaningful bits fit in the previous window
+		c.b.writeBit(false)
+		c.b.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+	sigbits := 64 - leading - trailing
+
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+	// 64 significant bits do not fit in 6 bits and are stored as 0
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(delta>>trailing, int(sigbits))
+}
+
+// bitRange reports whether x fits in nbits as a two's complement number
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// Iterator returns an iterator over a snapshot of the chunk
+func (c *xorChunk) Iterator() *xorIterator {
+	data := append([]byte(nil), c.b.bytes()...)
+
+	return &xorIterator{
+		br:  newBReader(data[2:]),
+		num: binary.BigEndian.Uint16(data),
+	}
+}
+
+type xorIterator struct {
+	br  bstreamReader
+	num uint16
+	i   uint16
+
+	t        int64
+	v        float64
+	tDelta   int64
+	leading  uint8
+	trailing uint8
+	err      error
+}
+
+func (it *xorIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *xorIterator) Err() error {
+	return it.err
+}
+
+func (it *xorIterator) Next() bool {
+	if it.err != nil || it.i == it.num {
+		return false
+	}
+
+	switch it.i {
+	case 0:
+		t, err := binary.ReadVarint(&it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t, it.v = t, math.Float64frombits(v)
+	case 1:
+		tDelta, err := binary.ReadVarint(&it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = tDelta
+		it.t += tDelta
+		if !it.readValue() {
+			return false
+		}
+	default:
+		var prefix uint8
+		for i := 0; i < 4; i++ {
+			bit, err := it.br.readBit()
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if !bit {
+				break
+			}
+			prefix++
+		}
+
+		var size int
+		switch prefix {
+		case 1:
+			size = 14
+		case 2:
+			size = 17
+		case 3:
+			size = 20
+		case 4:
+			size = 64
+		}
+
+		var dod int64
+		if size > 0 {
+			raw, err := it.br.readBits(size)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			dod = int64(raw)
+			if size < 64 && raw > 1<<(size-1) {
+				// sign extend
+				dod = int64(raw) - 1<<size
+			}
+		}
+
+		it.tDelta += dod
+		it.t += it.tDelta
+		if !it.readValue() {
+			return false
+		}
+	}
+
+	it.i++
+	return true
+}
+
+func (it *xorIterator) readValue() bool {
+	bit, err := it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if !bit {
+		return true
+	}
+
+	bit, err = it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if bit {
+		leading, err := it.br.readBits(5)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		sigbits, err := it.br.readBits(6)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		it.leading = uint8(leading)
+		it.trailing = 64 - it.leading - uint8(sigbits)
+	}
+
+	sigbits := 64 - int(it.leading) - int(it.trailing)
+	raw, err := it.br.readBits(sigbits)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.v = math.Float64frombits(math.Float64bits(it.v) ^ raw<<it.trailing)
+
+	return true
+}
+
+// bstream is an append-only bit stream
+type bstream struct {
+	stream []byte
+	// count of bits still free in the last byte
+	free uint8
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.free == 0 {
+		b.stream = append(b.stream, 0)
+		b.free = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.free - 1)
+	}
+	b.free--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.free == 0 {
+		b.stream = append(b.stream, byt)
+		return
+	}
+
+	i := len(b.stream) - 1
+	b.stream[i] |= byt >> (8 - b.free)
+	b.stream = append(b.stream, byt<<b.free)
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+type bstreamReader struct {
+	stream []byte
+	pos    int
+	// bits already consumed from stream[pos]
+	used uint8
+}
+
+func newBReader(data []byte) bstreamReader {
+	return bstreamReader{stream: data}
+}
+
+var errChunkEOF = fmt.Errorf("unexpected end of chunk")
+
+func (r *bstreamReader) readBit() (bool, error) {
+	if r.pos >= len(r.stream) {
+		return false, errChunkEOF
+	}
+
+	bit := r.stream[r.pos]&(1<<(7-r.used)) != 0
+	r.used++
+	if r.used == 8 {
+		r.pos++
+		r.used = 0
+	}
+
+	return bit, nil
+}
+
+// ReadByte lets binary.ReadVarint consume the stream
+func (r *bstreamReader) ReadByte() (byte, error) {
+	v, err := r.readBits(8)
+	return byte(v), err
+}
+
+func (r *bstreamReader) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for nbits > 0 {
+		if r.pos >= len(r.stream) {
+			return 0, errChunkEOF
+		}
+
+		if r.used == 0 && nbits >= 8 {
+			u = u<<8 | uint64(r.stream[r.pos])
+			r.pos++
+			nbits -= 8
+			continue
+		}
+
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+		nbits--
+	}
+
+	return u, nil
+}
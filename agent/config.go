@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the agent configuration file
+type Config struct {
+	// RelabelConfigs are applied to every target before it is scraped
+	RelabelConfigs []*RelabelConfig `yaml:"relabel_configs"`
+	// MetricRelabelConfigs are applied to every scraped sample
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs"`
+	// RuleGroups are evaluated against the stored metrics
+	RuleGroups []*RuleGroupConfig `yaml:"rule_groups"`
+	Alerting   AlertingConfig     `yaml:"alerting"`
+	// Control enables starting, stopping and removing containers over the API
+	Control ControlConfig `yaml:"control"`
+	// LogMetrics derive counters and histograms from container log lines
+	LogMetrics []*LogMetricConfig `yaml:"log_metrics"`
+}
+
+type AlertingConfig struct {
+	Route    RouteConfig     `yaml:"route"`
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+}
+
+// Duration is a duration written like 30s or 1h30m in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return formatDuration(time.Duration(d)), nil
+}
+
+// LoadConfig reads and validates a YAML configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading config: %w", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed parsing config: %w", err)
+	}
+
+	if err := CompileRelabelConfigs(cfg.RelabelConfigs); err != nil {
+		return nil, fmt.Errorf("relabel_configs: %w", err)
+	}
+	if err := CompileRelabelConfigs(cfg.MetricRelabelConfigs); err != nil {
+		return nil, fmt.Errorf("metric_relabel_configs: %w", err)
+	}
+	if err := CompileRuleGroups(cfg.RuleGroups); err != nil {
+		return nil, fmt.Errorf("rule_groups: %w", err)
+	}
+	for i, webhook := range cfg.Alerting.Webhooks {
+		if webhook.URL == "" {
+			return nil, fmt.Errorf("alerting: webhook %d: url is required", i)
+		}
+	}
+
+	if err := CompileLogMetrics(cfg.LogMetrics); err != nil {
+		return nil, fmt.Errorf("log_metrics: %w", err)
+	}
+	if err := cfg.Control.validate(); err != nil {
+		return nil, fmt.Errorf("control: %w", err)
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+// Container groupings besides arbitrary label keys
+const (
+	GroupByProject = "project"
+	GroupByService = "service"
+)
+
+// ContainerGroup is the containers sharing the values of the grouping labels.
+// Containers without a label are grouped under its empty value.
+type ContainerGroup struct {
+	// Labels are the grouping labels and their values
+	Labels     map[string]string  `json:"labels"`
+	Containers []ContainerSummary `json:"containers"`
+	// States counts the containers by state, e.g. running or exited
+	States map[string]int `json:"states"`
+	// CPUPercent and the memory totals are the sums over the running
+	// containers, only set with stats
+	CPUPercent       float64 `json:"cpuPercent"`
+	MemoryUsageBytes int64   `json:"memoryUsageBytes"`
+	MemoryLimitBytes int64   `json:"memoryLimitBytes"`
+}
+
+type ContainerSummary struct {
+	ID     string                   `json:"id"`
+	Name   string                   `json:"name"`
+	Image  string                   `json:"image"`
+	State  string                   `json:"state"`
+	Status string                   `json:"status"`
+	Stats  *metricus.ContainerStats `json:"stats,omitempty"`
+}
+
+// groupLabelKeys returns the label keys a grouping groups by, by is project,
+// service or a label key
+func groupLabelKeys(by string) ([]string, error) {
+	switch by {
+	case "", GroupByProject:
+		return []string{ComposeProjectLabel}, nil
+	case GroupByService:
+		return []string{ComposeProjectLabel, ComposeServiceLabel}, nil
+	}
+	if strings.ContainsAny(by, "= ") {
+		return nil, fmt.Errorf("invalid label key %q", by)
+	}
+
+	return []string{by}, nil
+}
+
+// groupContainers groups the containers by the values of the label keys,
+// ordered by those values
+func groupContainers(containers []types.Container, keys []string) []*ContainerGroup {
+	groups := make(map[string]*ContainerGroup)
+	for _, container := range containers {
+		values := make([]string, len(keys))
+		for i, key := range keys {
+			values[i] = container.Labels[key]
+		}
+		id := strings.Join(values, "\x00")
+
+		group, ok := groups[id]
+		if !ok {
+			group = &ContainerGroup{Labels: make(map[string]string, len(keys)), States: make(map[string]int)}
+			for i, key := range keys {
+				group.Labels[key] = values[i]
+			}
+			groups[id] = group
+		}
+
+		group.Containers = append(group.Containers, ContainerSummary{
+			ID:     shortID(container.ID),
+			Name:   containerName(container),
+			Image:  container.Image,
+			State:  container.State,
+			Status: container.Status,
+		})
+		group.States[container.State]++
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	sorted := make([]*ContainerGroup, 0, len(ids))
+	for _, id := range ids {
+		group := groups[id]
+		sort.Slice(group.Containers, func(i, j int) bool { return group.Containers[i].Name < group.Containers[j].Name })
+		sorted = append(sorted, group)
+	}
+
+	return sorted
+}
+
+// addGroupStats reads the stats of the running containers of the groups, all
+// at once as each read takes about a second, and sums them per group
+func addGroupStats(ctx context.Context, docker *metricus.DockerService, groups []*ContainerGroup) {
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		for i := range group.Containers {
+			if group.Containers[i].State != "running" {
+				continue
+			}
+
+			wg.Add(1)
+			go func(summary *ContainerSummary) {
+				defer wg.Done()
+
+				stats, err := docker.GetContainerStats(ctx, summary.ID)
+				if err != nil {
+					log.Warn().Err(err).Str("container", summary.ID).Msg("error reading container stats")
+					return
+				}
+				summary.Stats = &stats
+			}(&group.Containers[i])
+		}
+	}
+	wg.Wait()
+
+	for _, group := range groups {
+		for _, summary := range group.Containers {
+			if summary.Stats == nil {
+				continue
+			}
+			group.CPUPercent += summary.Stats.CPUPercent
+			group.MemoryUsageBytes += summary.Stats.MemoryUsageBytes
+			group.MemoryLimitBytes += summary.Stats.MemoryLimitBytes
+		}
+	}
+}
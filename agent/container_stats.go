@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultContainerStatsIntervalSeconds = 10
+
+// Labels of the container stats series
+const (
+	ContainerIDLabel             = "container_id"
+	ContainerNameLabel           = "container_name"
+	ContainerImageLabel          = "image"
+	ContainerComposeProjectLabel = "compose_project"
+	ContainerComposeServiceLabel = "compose_service"
+	NetworkInterfaceLabel        = "interface"
+)
+
+// Docker labels set by docker compose
+const (
+	ComposeProjectLabel = "com.docker.compose.project"
+	ComposeServiceLabel = "com.docker.compose.service"
+)
+
+type ContainerStatsOptions struct {
+	IntervalSeconds int
+}
+
+// ContainerStatsCollector samples the docker stats of every running container
+// and appends them as container_* series so that they can be queried and
+// alerted on like scraped metrics
+type ContainerStatsCollector struct {
+	Options ContainerStatsOptions
+
+	docker   *metricus.DockerService
+	appender Appender
+}
+
+func NewContainerStatsCollector(docker *metricus.DockerService, appender Appender, opts ContainerStatsOptions) *ContainerStatsCollector {
+	if opts.IntervalSeconds <= 0 {
+		opts.IntervalSeconds = DefaultContainerStatsIntervalSeconds
+	}
+
+	return &ContainerStatsCollector{Options: opts, docker: docker, appender: appender}
+}
+
+func (c *ContainerStatsCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(c.Options.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collect(ctx); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("error collecting container stats")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *ContainerStatsCollector) collect(ctx context.Context) error {
+	containers, err := c.docker.GetContainersByLabel(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		samples []Sample
+	)
+	for _, container := range containers {
+		wg.Add(1)
+		go func(container types.Container) {
+			defer wg.Done()
+
+			stats, err := c.docker.GetContainerMetrics(ctx, container.ID)
+			if err != nil {
+				log.Warn().Err(err).Str("container", container.ID).Msg("error reading container stats")
+				return
+			}
+
+			mu.Lock()
+			samples = append(samples, containerStatsSamples(stats, container, time.Now().UnixMilli())...)
+			mu.Unlock()
+		}(container)
+	}
+	wg.Wait()
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	return c.appender.Append(samples)
+}
+
+// containerStatsSamples stores counters as totals, so that their rates are
+// computed at query time, and the derived percentages as gauges
+func containerStatsSamples(stats *metricus.Stats, container types.Container, ts int64) []Sample {
+	base := containerLabels(container)
+
+	sample := func(name string, v float64, extra ...string) Sample {
+		lb := NewLabelsBuilder(base).Set(MetricNameLabel, name)
+		for i := 0; i+1 < len(extra); i += 2 {
+			lb.Set(extra[i], extra[i+1])
+		}
+		return Sample{Labels: lb.Labels(), T: ts, V: v}
+	}
+
+	derived := metricus.NewContainerStats(stats, nil)
+
+	samples := []Sample{
+		sample("container_cpu_usage_seconds_total", float64(stats.CPUStats.CPUUsage.TotalUsage)/1e9),
+		sample("container_cpu_percent", derived.CPUPercent),
+		sample("container_memory_usage_bytes", float64(derived.MemoryUsageBytes)),
+		sample("container_memory_inactive_file_bytes", float64(derived.MemoryInactiveFileBytes)),
+		sample("container_memory_limit_bytes", float64(derived.MemoryLimitBytes)),
+		sample("container_memory_percent", derived.MemoryPercent),
+		sample("container_blkio_read_bytes_total", float64(derived.BlockReadBytes)),
+		sample("container_blkio_write_bytes_total", float64(derived.BlockWriteBytes)),
+		sample("container_pids", float64(derived.PIDs)),
+	}
+	for name, n := range derived.Networks {
+		samples = append(samples,
+			sample("container_network_receive_bytes_total", float64(n.RxBytes), NetworkInterfaceLabel, name),
+			sample("container_network_transmit_bytes_total", float64(n.TxBytes), NetworkInterfaceLabel, name),
+		)
+	}
+
+	return samples
+}
+
+// containerLabels are the labels identifying a container's series
+func containerLabels(container types.Container) Labels {
+	return NewLabelsBuilder(nil).
+		Set(ContainerIDLabel, shortID(container.ID)).
+		Set(ContainerNameLabel, containerName(container)).
+		Set(ContainerImageLabel, container.Image).
+		Set(ContainerComposeProjectLabel, container.Labels[ComposeProjectLabel]).
+		Set(ContainerComposeServiceLabel, container.Labels[ComposeServiceLabel]).
+		Labels()
+}
+
+func isHexID(id string) bool {
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return id != ""
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+
+	return id
+}
+
+// defaultHistoryPoints is the number of points of a stats history without a
+// step
+const defaultHistoryPoints = 250
+
+// containerHistoryQueries collapse the series of a container, which differ
+// when it was recreated from another image, into one per value. %[1]s is the
+// container matcher and %[2]s the rate window.
+var containerHistoryQueries = map[string]string{
+	"cpuPercent":               `max(container_cpu_percent{%[1]s})`,
+	"memoryUsageBytes":         `max(container_memory_usage_bytes{%[1]s})`,
+	"memoryLimitBytes":         `max(container_memory_limit_bytes{%[1]s})`,
+	"memoryPercent":            `max(container_memory_percent{%[1]s})`,
+	"pids":                     `max(container_pids{%[1]s})`,
+	"blockReadBytesPerSecond":  `sum(rate(container_blkio_read_bytes_total{%[1]s}[%[2]s]))`,
+	"blockWriteBytesPerSecond": `sum(rate(container_blkio_write_bytes_total{%[1]s}[%[2]s]))`,
+	"networkRxBytesPerSecond":  `sum(rate(container_network_receive_bytes_total{%[1]s}[%[2]s]))`,
+	"networkTxBytesPerSecond":  `sum(rate(container_network_transmit_bytes_total{%[1]s}[%[2]s]))`,
+}
+
+// ContainerStatsHistory is the stored stats of one container between From
+// and To, one point per step
+type ContainerStatsHistory struct {
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	StepSeconds float64            `json:"stepSeconds"`
+	Series      map[string][]Point `json:"series"`
+}
+
+// containerStatsHistory evaluates every history query for the container
+// selected by matcher. window is the range rates are taken over and must span
+// at least two collections.
+func containerStatsHistory(engine *Engine, matcher *Matcher, from, to time.Time, step, window time.Duration) (*ContainerStatsHistory, error) {
+	history := &ContainerStatsHistory{
+		From:        from,
+		To:          to,
+		StepSeconds: step.Seconds(),
+		Series:      make(map[string][]Point, len(containerHistoryQueries)),
+	}
+
+	for name, query := range containerHistoryQueries {
+		matrix, err := engine.Range(fmt.Sprintf(query, matcher, formatDuration(window)), from, to, step)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		points := []Point{}
+		if len(matrix) > 0 {
+			points = matrix[0].Points
+		}
+		history.Series[name] = points
+	}
+
+	return history, nil
+}
@@ -0,0 +1,349 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/gorilla/websocket"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// auditBacklog is the number of audit entries kept in memory
+const auditBacklog = 500
+
+// actorKey is the echo context key of the name of the authorized token
+const actorKey = "actor"
+
+// ControlConfig enables the endpoints that change containers
+type ControlConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Tokens are the bearer tokens allowed to call the control endpoints
+	Tokens []APITokenConfig `yaml:"tokens"`
+	Exec   ExecConfig       `yaml:"exec"`
+}
+
+// APITokenConfig is a bearer token, its name is recorded in the audit log
+type APITokenConfig struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+func (c *ControlConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Tokens) == 0 {
+		return fmt.Errorf("at least one token is required")
+	}
+	for i, token := range c.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return fmt.Errorf("token %d: name and token are required", i)
+		}
+	}
+
+	return c.Exec.compile()
+}
+
+// authorize returns the name of the request's token, false when no token
+// matches
+func (c ControlConfig) authorize(r *http.Request) (string, bool) {
+	bearer := bearerToken(r)
+	if bearer == "" {
+		return "", false
+	}
+
+	for _, token := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token.Token)) == 1 {
+			return token.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// bearerToken reads the token of the Authorization header or, since browsers
+// cannot set headers on WebSocket requests, of a "bearer.<token>" WebSocket
+// subprotocol
+func bearerToken(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		return bearer
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if bearer, ok := strings.CutPrefix(protocol, bearerSubprotocolPrefix); ok {
+			return bearer
+		}
+	}
+
+	return ""
+}
+
+// requireControl rejects requests when control is disabled or the request
+// has no valid bearer token
+func requireControl(cfg ControlConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !cfg.Enabled {
+				return echo.NewHTTPError(http.StatusForbidden, "container control is disabled")
+			}
+
+			actor, ok := cfg.authorize(c.Request())
+			if !ok {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid or missing bearer token")
+			}
+			c.Set(actorKey, actor)
+
+			return next(c)
+		}
+	}
+}
+
+// AuditEntry records one control action
+type AuditEntry struct {
+	Time        time.Time         `json:"time"`
+	Actor       string            `json:"actor"`
+	RemoteAddr  string            `json:"remoteAddr"`
+	Action      string            `json:"action"`
+	ContainerID string            `json:"containerId"`
+	Params      map[string]string `json:"params,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// AuditLog appends entries as JSON lines to a file and keeps the most recent
+// ones in memory
+type AuditLog struct {
+	path string
+
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// OpenAuditLog loads the recent entries of the log at path. An empty path
+// keeps them in memory only.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{path: path}
+	if path == "" {
+		return l, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed opening audit log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		l.add(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading audit log: %w", err)
+	}
+
+	return l, nil
+}
+
+func (l *AuditLog) Record(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.add(entry)
+	if l.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return fmt.Errorf("failed creating audit log dir: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed opening audit log: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Entries returns the recent entries, newest first
+func (l *AuditLog) Entries() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]AuditEntry, len(l.entries))
+	for i, entry := range l.entries {
+		entries[len(entries)-1-i] = entry
+	}
+
+	return entries
+}
+
+func (l *AuditLog) add(entry AuditEntry) {
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > auditBacklog {
+		l.entries = l.entries[len(l.entries)-auditBacklog:]
+	}
+}
+
+// containerAction runs a control action with the request's query parameters
+type containerAction func(ctx context.Context, docker *metricus.DockerService, containerID string, params map[string]string) error
+
+var containerActions = map[string]containerAction{
+	"start": func(ctx context.Context, docker *metricus.DockerService, id string, _ map[string]string) error {
+		return docker.StartContainer(ctx, id)
+	},
+	"stop": func(ctx context.Context, docker *metricus.DockerService, id string, params map[string]string) error {
+		opts, err := stopOptions(params)
+		if err != nil {
+			return err
+		}
+		return docker.StopContainer(ctx, id, opts)
+	},
+	"restart": func(ctx context.Context, docker *metricus.DockerService, id string, params map[string]string) error {
+		opts, err := stopOptions(params)
+		if err != nil {
+			return err
+		}
+		return docker.RestartContainer(ctx, id, opts)
+	},
+	"pause": func(ctx context.Context, docker *metricus.DockerService, id string, _ map[string]string) error {
+		return docker.PauseContainer(ctx, id)
+	},
+	"unpause": func(ctx context.Context, docker *metricus.DockerService, id string, _ map[string]string) error {
+		return docker.UnpauseContainer(ctx, id)
+	},
+	"kill": func(ctx context.Context, docker *metricus.DockerService, id string, params map[string]string) error {
+		return docker.KillContainer(ctx, id, params["signal"])
+	},
+	"remove": func(ctx context.Context, docker *metricus.DockerService, id string, params map[string]string) error {
+		force, err := boolParam(params, "force")
+		if err != nil {
+			return err
+		}
+		volumes, err := boolParam(params, "volumes")
+		if err != nil {
+			return err
+		}
+		return docker.RemoveContainer(ctx, id, metricus.RemoveOptions{Force: force, RemoveVolumes: volumes})
+	},
+}
+
+// controlParams are the query parameters the actions read
+var controlParams = []string{"timeout", "signal", "force", "volumes"}
+
+func stopOptions(params map[string]string) (metricus.StopOptions, error) {
+	opts := metricus.StopOptions{Signal: params["signal"]}
+	if value, ok := params["timeout"]; ok {
+		timeout, err := strconv.Atoi(value)
+		if err != nil || timeout < -1 {
+			return opts, echo.NewHTTPError(http.StatusBadRequest, "timeout must be a number of seconds or -1")
+		}
+		opts.Timeout = &timeout
+	}
+
+	return opts, nil
+}
+
+func boolParam(params map[string]string, name string) (bool, error) {
+	value, ok := params[name]
+	if !ok {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be true or false", name))
+	}
+
+	return b, nil
+}
+
+// controlContainer runs the action named by the route and records it in the
+// audit log, whether it succeeded or not
+func controlContainer(a *Agent, action string) echo.HandlerFunc {
+	run := containerActions[action]
+
+	return func(c echo.Context) error {
+		containerID := c.Param("containerId")
+		params := make(map[string]string)
+		for _, name := range controlParams {
+			if c.QueryParams().Has(name) {
+				params[name] = c.QueryParam(name)
+			}
+		}
+
+		err := run(c.Request().Context(), a.Options.Docker, containerID, params)
+		audit(a, c, action, containerID, params, err)
+
+		return controlError(c, err, action, containerID)
+	}
+}
+
+// audit records a control action and logs it
+func audit(a *Agent, c echo.Context, action, containerID string, params map[string]string, err error) {
+	entry := AuditEntry{
+		Time:        time.Now(),
+		Actor:       fmt.Sprint(c.Get(actorKey)),
+		RemoteAddr:  c.RealIP(),
+		Action:      action,
+		ContainerID: containerID,
+		Params:      params,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	log.Info().
+		Str("actor", entry.Actor).
+		Str("action", action).
+		Str("container", containerID).
+		Err(err).
+		Msg("container control")
+	if err := a.Audit.Record(entry); err != nil {
+		log.Error().Err(err).Msg("error writing audit log")
+	}
+}
+
+// controlError responds to a control action, mapping docker errors to HTTP
+// statuses
+func controlError(c echo.Context, err error, action, containerID string) error {
+	switch {
+	case err == nil:
+		return c.NoContent(http.StatusNoContent)
+	case errdefs.IsNotFound(err):
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("container(%s) not found", containerID))
+	case errdefs.IsConflict(err):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errdefs.IsInvalidParameter(err):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if httpErr, ok := err.(*echo.HTTPError); ok {
+		return httpErr
+	}
+
+	return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("error running %s on container(%s)", action, containerID))
+}
@@ -0,0 +1,11 @@
+package agent
+
+import "context"
+
+// Discoverer produces the current set of scrape targets for one source.
+// Run calls update with the full target list every time it changes and
+// blocks until ctx is cancelled.
+type Discoverer interface {
+	Name() string
+	Run(ctx context.Context, update func([]ScrapeOptions)) error
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+// Container labels read by DockerDiscovery
+const (
+	LabelScrape   = "metricus.scrape"
+	LabelPort     = "metricus.port"
+	LabelPath     = "metricus.path"
+	LabelScheme   = "metricus.scheme"
+	LabelInterval = "metricus.interval"
+	LabelNetwork  = "metricus.network"
+	// LabelJob is the job label of the target, docker by default
+	LabelJob = "metricus.job"
+)
+
+// Meta labels available during target relabeling of docker targets
+const (
+	MetaDockerContainerIDLabel   = "__meta_docker_container_id"
+	MetaDockerContainerNameLabel = "__meta_docker_container_name"
+	MetaDockerImageLabel         = "__meta_docker_container_image"
+	MetaDockerLabelPrefix        = "__meta_docker_container_label_"
+)
+
+const dockerReconnectDelay = 5 * time.Second
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type DockerDiscoveryOptions struct {
+	// Network is used to resolve container addresses when a container does
+	// not set the metricus.network label. Empty means the first network.
+	Network                string
+	DefaultIntervalSeconds int
+}
+
+// DockerDiscovery finds scrape targets from labels on running containers and
+// keeps them up to date from the docker events API
+type DockerDiscovery struct {
+	Options DockerDiscoveryOptions
+
+	docker *metricus.DockerService
+}
+
+func NewDockerDiscovery(docker *metricus.DockerService, opts DockerDiscoveryOptions) *DockerDiscovery {
+	return &DockerDiscovery{Options: opts, docker: docker}
+}
+
+func (d *DockerDiscovery) Name() string {
+	return "docker"
+}
+
+func (d *DockerDiscovery) Run(ctx context.Context, update func([]ScrapeOptions)) error {
+	for {
+		err := d.watch(ctx, update)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Warn().Err(err).Msg("docker discovery interrupted, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dockerReconnectDelay):
+		}
+	}
+}
+
+func (d *DockerDiscovery) watch(ctx context.Context, update func([]ScrapeOptions)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// subscribe before listing so no container started in between is missed
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.docker.StreamEvents(ctx, metricus.EventFilter{
+			Types:  []string{string(events.ContainerEventType)},
+			Labels: []string{LabelScrape + "=true"},
+		}, messages)
+	}()
+	if err := d.refresh(ctx, update); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return fmt.Errorf("docker event stream closed: %w", err)
+		case message := <-messages:
+			switch message.Action {
+			case events.ActionStart, events.ActionRestart, events.ActionUnPause,
+				events.ActionDie, events.ActionStop, events.ActionPause, events.ActionDestroy:
+				if err := d.refresh(ctx, update); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (d *DockerDiscovery) refresh(ctx context.Context, update func([]ScrapeOptions)) error {
+	containers, err := d.docker.GetContainersByLabel(ctx, LabelScrape+"=true")
+	if err != nil {
+		return fmt.Errorf("failed listing containers: %w", err)
+	}
+
+	targets := make([]ScrapeOptions, 0, len(containers))
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+
+		target, err := d.target(c)
+		if err != nil {
+			log.Warn().Err(err).Str("container", c.ID).Msg("skipping container")
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	update(targets)
+
+	return nil
+}
+
+func (d *DockerDiscovery) target(c types.Container) (ScrapeOptions, error) {
+	port := c.Labels[LabelPort]
+	if port == "" {
+		if len(c.Ports) != 1 {
+			return ScrapeOptions{}, fmt.Errorf("%s label is required when a container exposes %d ports", LabelPort, len(c.Ports))
+		}
+		port = strconv.Itoa(int(c.Ports[0].PrivatePort))
+	}
+
+	address, err := d.address(c)
+	if err != nil {
+		return ScrapeOptions{}, err
+	}
+
+	scheme := c.Labels[LabelScheme]
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	interval := d.Options.DefaultIntervalSeconds
+	if value := c.Labels[LabelInterval]; value != "" {
+		if interval, err = strconv.Atoi(value); err != nil {
+			return ScrapeOptions{}, fmt.Errorf("invalid %s label %q: %w", LabelInterval, value, err)
+		}
+	}
+
+	labels := map[string]string{
+		MetaDockerContainerIDLabel: c.ID,
+		MetaDockerImageLabel:       c.Image,
+	}
+	if len(c.Names) > 0 {
+		labels[MetaDockerContainerNameLabel] = strings.TrimPrefix(c.Names[0], "/")
+	}
+	if job := c.Labels[LabelJob]; job != "" {
+		labels[JobLabel] = job
+	}
+	for name, value := range c.Labels {
+		labels[MetaDockerLabelPrefix+invalidLabelChars.ReplaceAllString(name, "_")] = value
+	}
+
+	return ScrapeOptions{
+		Host:            fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(address, port)),
+		Path:            c.Labels[LabelPath],
+		IntervalSeconds: interval,
+		Labels:          labels,
+	}, nil
+}
+
+func (d *DockerDiscovery) address(c types.Container) (string, error) {
+	if c.NetworkSettings == nil || len(c.NetworkSettings.Networks) == 0 {
+		return "", fmt.Errorf("container has no networks")
+	}
+
+	network := c.Labels[LabelNetwork]
+	if network == "" {
+		network = d.Options.Network
+	}
+	if network != "" {
+		endpoint := c.NetworkSettings.Networks[network]
+		if endpoint == nil || endpoint.IPAddress == "" {
+			return "", fmt.Errorf("container has no address on network %q", network)
+		}
+		return endpoint.IPAddress, nil
+	}
+
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if endpoint := c.NetworkSettings.Networks[name]; endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress, nil
+		}
+	}
+
+	return "", fmt.Errorf("container has no network address")
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// MetaFilepathLabel is available during target relabeling
+const MetaFilepathLabel = "__meta_filepath"
+
+const (
+	DefaultFileRefreshIntervalSeconds = 300
+
+	// fileReloadDelay batches the bursts of events editors and provisioning
+	// tools produce when rewriting a file
+	fileReloadDelay = 250 * time.Millisecond
+)
+
+// TargetGroup is one entry of a file discovery document. Targets are
+// "host:port" or full "scheme://host:port" addresses. The __scheme__ and
+// __metrics_path__ labels configure the scrape, other labels starting with
+// "__" are only visible to target relabeling.
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+type FileDiscoveryOptions struct {
+	// Files are paths or glob patterns of JSON or YAML target files
+	Files []string
+	// RefreshIntervalSeconds re-reads every file periodically in case a
+	// filesystem event was missed
+	RefreshIntervalSeconds int
+	DefaultIntervalSeconds int
+}
+
+// FileDiscovery reads scrape targets from files and reloads them whenever
+// they change on disk
+type FileDiscovery struct {
+	Options FileDiscoveryOptions
+
+	// last successfully parsed targets per file, kept when a rewrite is invalid
+	targets map[string][]ScrapeOptions
+}
+
+func NewFileDiscovery(opts FileDiscoveryOptions) *FileDiscovery {
+	if opts.RefreshIntervalSeconds <= 0 {
+		opts.RefreshIntervalSeconds = DefaultFileRefreshIntervalSeconds
+	}
+	files := make([]string, len(opts.Files))
+	for i, pattern := range opts.Files {
+		files[i] = filepath.Clean(pattern)
+	}
+	opts.Files = files
+
+	return &FileDiscovery{
+		Options: opts,
+		targets: make(map[string][]ScrapeOptions),
+	}
+}
+
+func (d *FileDiscovery) Name() string {
+	return "file"
+}
+
+func (d *FileDiscovery) Run(ctx context.Context, update func([]ScrapeOptions)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed creating file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// watch directories rather than files so that atomic renames and files
+	// created later that match a glob are picked up
+	dirs := make(map[string]struct{})
+	for _, pattern := range d.Options.Files {
+		dirs[filepath.Dir(pattern)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Warn().Err(err).Str("dir", dir).Msg("failed watching directory, relying on periodic refresh")
+		}
+	}
+
+	d.reload(update)
+
+	ticker := time.NewTicker(time.Duration(d.Options.RefreshIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	reload := time.NewTimer(fileReloadDelay)
+	reload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			reload.Stop()
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("file watcher closed")
+			}
+			if d.matches(event.Name) {
+				reload.Reset(fileReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("file watcher closed")
+			}
+			log.Warn().Err(err).Msg("file watcher error")
+		case <-reload.C:
+			d.reload(update)
+		case <-ticker.C:
+			d.reload(update)
+		}
+	}
+}
+
+func (d *FileDiscovery) matches(name string) bool {
+	for _, pattern := range d.Options.Files {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *FileDiscovery) reload(update func([]ScrapeOptions)) {
+	seen := make(map[string]struct{})
+	for _, pattern := range d.Options.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Error().Err(err).Str("pattern", pattern).Msg("invalid file discovery pattern")
+			continue
+		}
+
+		for _, file := range files {
+			seen[file] = struct{}{}
+
+			targets, err := d.readFile(file)
+			if err != nil {
+				log.Error().Err(err).Str("file", file).Msg("failed reading targets file, keeping previous targets")
+				continue
+			}
+			d.targets[file] = targets
+		}
+	}
+
+	for file := range d.targets {
+		if _, ok := seen[file]; !ok {
+			delete(d.targets, file)
+		}
+	}
+
+	files := make([]string, 0, len(d.targets))
+	for file := range d.targets {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var targets []ScrapeOptions
+	for _, file := range files {
+		targets = append(targets, d.targets[file]...)
+	}
+
+	update(targets)
+}
+
+func (d *FileDiscovery) readFile(file string) ([]ScrapeOptions, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []TargetGroup
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		err = json.Unmarshal(data, &groups)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &groups)
+	default:
+		return nil, fmt.Errorf("unsupported file extension %q", filepath.Ext(file))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing targets: %w", err)
+	}
+
+	var targets []ScrapeOptions
+	for _, group := range groups {
+		for _, address := range group.Targets {
+			target, err := d.target(file, address, group.Labels)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+func (d *FileDiscovery) target(file, address string, groupLabels map[string]string) (ScrapeOptions, error) {
+	if address == "" {
+		return ScrapeOptions{}, fmt.Errorf("empty target address")
+	}
+
+	labels := make(map[string]string, len(groupLabels)+1)
+	for name, value := range groupLabels {
+		labels[name] = value
+	}
+	labels[MetaFilepathLabel] = file
+
+	host := address
+	if !strings.Contains(address, "://") {
+		scheme := groupLabels[SchemeLabel]
+		if scheme == "" {
+			scheme = "http"
+		}
+		host = scheme + "://" + address
+	}
+
+	return ScrapeOptions{
+		Host:            host,
+		Path:            groupLabels[MetricsPathLabel],
+		IntervalSeconds: d.Options.DefaultIntervalSeconds,
+		Labels:          labels,
+	}, nil
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultGroupWait      = 30 * time.Second
+	DefaultGroupInterval  = 5 * time.Minute
+	DefaultRepeatInterval = 4 * time.Hour
+
+	// GroupByAll as the only group_by label puts every alert in its own group
+	GroupByAll = "..."
+
+	dispatchTick = time.Second
+)
+
+// RouteConfig controls how alerts are batched into notifications
+type RouteConfig struct {
+	// GroupBy are the labels whose values put alerts in the same notification
+	GroupBy []string `yaml:"group_by"`
+	// GroupWait is how long a new group waits for more alerts before the
+	// first notification
+	GroupWait Duration `yaml:"group_wait"`
+	// GroupInterval is how long a group waits before notifying about alerts
+	// added to or resolved in it
+	GroupInterval Duration `yaml:"group_interval"`
+	// RepeatInterval is how long a group waits before notifying again about
+	// the same firing alerts
+	RepeatInterval Duration `yaml:"repeat_interval"`
+}
+
+// Dispatcher groups the alerts of the rule manager and sends each group to
+// the receiver on the route's timers. Alerts are deduplicated by fingerprint
+// and alerts muted by a silence are not sent.
+type Dispatcher struct {
+	route    RouteConfig
+	silences *Silences
+	receiver Notifier
+
+	mu     sync.Mutex
+	groups map[uint64]*alertGroup
+	wg     sync.WaitGroup
+}
+
+type alertGroup struct {
+	labels   Labels
+	alerts   map[string]Alert
+	next     time.Time
+	flushing bool
+
+	// firing fingerprints of the last notification and when it was sent
+	sent     map[string]bool
+	lastSent time.Time
+}
+
+func NewDispatcher(route RouteConfig, silences *Silences, receiver Notifier) *Dispatcher {
+	if route.GroupWait <= 0 {
+		route.GroupWait = Duration(DefaultGroupWait)
+	}
+	if route.GroupInterval <= 0 {
+		route.GroupInterval = Duration(DefaultGroupInterval)
+	}
+	if route.RepeatInterval <= 0 {
+		route.RepeatInterval = Duration(DefaultRepeatInterval)
+	}
+
+	return &Dispatcher{
+		route:    route,
+		silences: silences,
+		receiver: receiver,
+		groups:   make(map[uint64]*alertGroup),
+	}
+}
+
+// Notify adds firing and resolved alerts to their groups. It does not block
+// on the receiver.
+func (d *Dispatcher) Notify(ctx context.Context, alerts []Alert) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for _, alert := range alerts {
+		labels := d.groupLabels(alert.Labels)
+		h := labels.Hash()
+
+		group, ok := d.groups[h]
+		if !ok {
+			if alert.State != AlertFiring {
+				// nothing was sent for it, so there is nothing to resolve
+				continue
+			}
+			group = &alertGroup{
+				labels: labels,
+				alerts: make(map[string]Alert),
+				next:   now.Add(time.Duration(d.route.GroupWait)),
+				sent:   make(map[string]bool),
+			}
+			d.groups[h] = group
+		}
+		group.alerts[alert.Fingerprint] = alert
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) groupLabels(ls Labels) Labels {
+	if len(d.route.GroupBy) == 1 && d.route.GroupBy[0] == GroupByAll {
+		return ls
+	}
+
+	lb := NewLabelsBuilder(nil)
+	for _, name := range d.route.GroupBy {
+		lb.Set(name, ls.Get(name))
+	}
+
+	return lb.Labels()
+}
+
+// Run flushes groups whose timer expired until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(dispatchTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.wg.Wait()
+			return
+		case now := <-ticker.C:
+			d.flushDue(ctx, now)
+		}
+	}
+}
+
+func (d *Dispatcher) flushDue(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for h, group := range d.groups {
+		if group.flushing || now.Before(group.next) {
+			continue
+		}
+		group.flushing = true
+		group.next = now.Add(time.Duration(d.route.GroupInterval))
+
+		d.wg.Add(1)
+		go func(h uint64, group *alertGroup) {
+			defer d.wg.Done()
+			d.flush(ctx, h, group, now)
+		}(h, group)
+	}
+}
+
+func (d *Dispatcher) flush(ctx context.Context, h uint64, group *alertGroup, now time.Time) {
+	d.mu.Lock()
+	var firing, resolved []Alert
+	for fp, alert := range group.alerts {
+		switch {
+		case alert.State == AlertResolved && !group.sent[fp]:
+			// resolved before it was ever sent as firing
+			delete(group.alerts, fp)
+		case alert.State == AlertResolved:
+			resolved = append(resolved, alert)
+		case d.silences != nil && len(d.silences.Mutes(alert.Labels)) > 0:
+		default:
+			firing = append(firing, alert)
+		}
+	}
+
+	changed := len(resolved) > 0 || len(firing) != len(group.sent)
+	for _, alert := range firing {
+		changed = changed || !group.sent[alert.Fingerprint]
+	}
+	repeat := len(firing) > 0 && now.Sub(group.lastSent) >= time.Duration(d.route.RepeatInterval)
+	d.mu.Unlock()
+
+	send := changed || repeat
+	if send && len(firing)+len(resolved) > 0 {
+		alerts := append(firing, resolved...)
+		sort.Slice(alerts, func(i, j int) bool { return compareLabels(alerts[i].Labels, alerts[j].Labels) < 0 })
+
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := d.receiver.Notify(ctx, alerts)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("group", group.labels.String()).Msg("error sending alert notification")
+			send = false
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group.flushing = false
+	if send {
+		group.sent = make(map[string]bool, len(firing))
+		for _, alert := range firing {
+			group.sent[alert.Fingerprint] = true
+		}
+		group.lastSent = now
+		for _, alert := range resolved {
+			// a newer evaluation may have replaced it with a firing alert
+			if current := group.alerts[alert.Fingerprint]; current.State == AlertResolved {
+				delete(group.alerts, alert.Fingerprint)
+			}
+		}
+	}
+
+	if len(group.alerts) == 0 {
+		delete(d.groups, h)
+	}
+}
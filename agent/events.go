@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultEventBacklog is the number of recent docker events kept for new
+// subscribers
+const DefaultEventBacklog = 256
+
+// DockerEvent is a docker event as sent to event stream subscribers
+type DockerEvent struct {
+	Type       string            `json:"type"`
+	Action     string            `json:"action"`
+	ActorID    string            `json:"actorId"`
+	Attributes map[string]string `json:"attributes"`
+	Scope      string            `json:"scope"`
+	Time       time.Time         `json:"time"`
+}
+
+func newDockerEvent(m events.Message) DockerEvent {
+	return DockerEvent{
+		Type:       string(m.Type),
+		Action:     string(m.Action),
+		ActorID:    m.Actor.ID,
+		Attributes: m.Actor.Attributes,
+		Scope:      m.Scope,
+		Time:       time.Unix(0, m.TimeNano),
+	}
+}
+
+// EventFilter selects events by type and action, empty lists match all. An
+// action also matches the actions that carry details after a colon, e.g.
+// exec_start matches "exec_start: sh".
+type EventFilter struct {
+	Types   []string
+	Actions []string
+}
+
+func (f EventFilter) Matches(e DockerEvent) bool {
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+	if len(f.Actions) == 0 {
+		return true
+	}
+
+	action, _, _ := strings.Cut(e.Action, ":")
+	return contains(f.Actions, action)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DockerEvents follows the docker event stream, keeps the most recent events
+// and publishes every event, JSON encoded, to its Hub
+type DockerEvents struct {
+	Hub *Hub
+
+	docker *metricus.DockerService
+
+	mu      sync.Mutex
+	backlog []DockerEvent
+	next    int
+	full    bool
+}
+
+func NewDockerEvents(docker *metricus.DockerService, backlogSize int) *DockerEvents {
+	if backlogSize <= 0 {
+		backlogSize = DefaultEventBacklog
+	}
+
+	return &DockerEvents{
+		Hub:     NewHub(backlogSize),
+		docker:  docker,
+		backlog: make([]DockerEvent, backlogSize),
+	}
+}
+
+// Run follows the event stream, reconnecting when it fails, until ctx is
+// cancelled
+func (e *DockerEvents) Run(ctx context.Context) {
+	for {
+		messages := make(chan events.Message)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- e.docker.StreamEvents(ctx, metricus.EventFilter{}, messages)
+		}()
+
+	stream:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-errs:
+				if ctx.Err() == nil {
+					log.Warn().Err(err).Msg("docker event stream interrupted, reconnecting")
+				}
+				break stream
+			case message := <-messages:
+				e.record(newDockerEvent(message))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dockerReconnectDelay):
+		}
+	}
+}
+
+func (e *DockerEvents) record(event DockerEvent) {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Msg("error encoding docker event")
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.backlog[e.next] = event
+	e.next = (e.next + 1) % len(e.backlog)
+	e.full = e.full || e.next == 0
+
+	e.Hub.Publish(msg)
+}
+
+// Subscribe returns the recent events, oldest first, and a subscription to
+// the events after them
+func (e *DockerEvents) Subscribe() ([]DockerEvent, *Subscription) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var backlog []DockerEvent
+	if e.full {
+		backlog = append(backlog, e.backlog[e.next:]...)
+	}
+	backlog = append(backlog, e.backlog[:e.next]...)
+
+	return backlog, e.Hub.Subscribe()
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultExecCommand runs when an exec request has no command
+	DefaultExecCommand = "/bin/sh"
+
+	// execSubprotocol is the WebSocket subprotocol of exec sessions. Clients
+	// must offer it, next to "bearer.<token>" when they send the token that
+	// way, since the response selects it and browsers fail the handshake when
+	// the server selects none of their subprotocols.
+	execSubprotocol = "metricus.exec"
+	// bearerSubprotocolPrefix carries the bearer token of browser WebSocket
+	// requests, e.g. "bearer.s3cret"
+	bearerSubprotocolPrefix = "bearer."
+
+	execPingInterval = 30 * time.Second
+	execPongWait     = 2 * execPingInterval
+	execWriteWait    = 10 * time.Second
+)
+
+// Stream bytes prefixed to the output frames of an exec session, the same as
+// docker's
+const (
+	execStdout byte = 1
+	execStderr byte = 2
+)
+
+// DefaultAllowedExecCommands are allowed when no allowed commands are
+// configured
+var DefaultAllowedExecCommands = []string{`(/bin/)?(ba)?sh`}
+
+// ExecConfig enables interactive commands in containers. Exec also requires
+// control to be enabled and a valid control token.
+type ExecConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// AllowedCommands are regexes matched against the whole command, its
+	// arguments joined by spaces
+	AllowedCommands []string `yaml:"allowed_commands"`
+
+	allowed []*regexp.Regexp
+}
+
+func (c *ExecConfig) compile() error {
+	patterns := c.AllowedCommands
+	if len(patterns) == 0 {
+		patterns = DefaultAllowedExecCommands
+	}
+
+	c.allowed = make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("exec: invalid allowed command %q: %w", pattern, err)
+		}
+		c.allowed = append(c.allowed, re)
+	}
+
+	return nil
+}
+
+func (c ExecConfig) allows(cmd []string) bool {
+	if c.allowed == nil {
+		if err := c.compile(); err != nil {
+			return false
+		}
+	}
+
+	command := strings.Join(cmd, " ")
+	for _, re := range c.allowed {
+		if re.MatchString(command) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// execMessage is a text frame of an exec session. Clients send stdin, resize
+// and close, which closes stdin; the server sends exit when the command ends.
+// Binary frames from clients are stdin, binary frames from the server are
+// output prefixed with its stream byte.
+type execMessage struct {
+	Type     string `json:"type"`
+	Data     string `json:"data,omitempty"`
+	Rows     uint   `json:"rows,omitempty"`
+	Cols     uint   `json:"cols,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+}
+
+// execConn serializes writes to the WebSocket, which allows one writer at a
+// time
+type execConn struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (c *execConn) write(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(execWriteWait))
+	return c.ws.WriteMessage(messageType, data)
+}
+
+// stream returns a writer of output frames of one stream
+func (c *execConn) stream(stream byte) writerFunc {
+	return func(p []byte) (int, error) {
+		if err := c.write(websocket.BinaryMessage, append([]byte{stream}, p...)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// execContainer attaches a WebSocket to a new command in the container. The
+// command is created before upgrading so that policy and docker errors are
+// plain HTTP errors. Requests must offer the metricus.exec subprotocol.
+func execContainer(a *Agent) echo.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{execSubprotocol},
+		// the API allows any origin and exec is authorized by token
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	return func(c echo.Context) error {
+		cfg := a.Options.Control.Exec
+		if !cfg.Enabled {
+			return echo.NewHTTPError(http.StatusForbidden, "exec is disabled")
+		}
+		if !slices.Contains(websocket.Subprotocols(c.Request()), execSubprotocol) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("exec requires the %s WebSocket subprotocol", execSubprotocol))
+		}
+
+		containerID := c.Param("containerId")
+		opts, err := execOptions(c)
+		if err != nil {
+			return err
+		}
+		params := map[string]string{"cmd": strings.Join(opts.Cmd, " "), "tty": strconv.FormatBool(opts.Tty)}
+		if !cfg.allows(opts.Cmd) {
+			err := echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("command %q is not allowed", params["cmd"]))
+			audit(a, c, "exec", containerID, params, err)
+			return err
+		}
+
+		session, err := a.Options.Docker.Exec(c.Request().Context(), containerID, opts)
+		audit(a, c, "exec", containerID, params, err)
+		if err != nil {
+			return controlError(c, err, "exec", containerID)
+		}
+		defer session.Close()
+
+		ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// the upgrader already responded
+			log.Warn().Err(err).Str("container", containerID).Msg("error upgrading exec connection")
+			return nil
+		}
+		defer ws.Close()
+
+		runExec(session, &execConn{ws: ws})
+
+		return nil
+	}
+}
+
+func execOptions(c echo.Context) (metricus.ExecOptions, error) {
+	opts := metricus.ExecOptions{
+		Cmd:        c.QueryParams()["cmd"],
+		Tty:        true,
+		User:       c.QueryParam("user"),
+		WorkingDir: c.QueryParam("workdir"),
+	}
+	if len(opts.Cmd) == 0 {
+		opts.Cmd = []string{DefaultExecCommand}
+	}
+
+	if value := c.QueryParam("tty"); value != "" {
+		tty, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, echo.NewHTTPError(http.StatusBadRequest, "tty must be true or false")
+		}
+		opts.Tty = tty
+	}
+	for name, size := range map[string]*uint{"rows": &opts.Height, "cols": &opts.Width} {
+		if value := c.QueryParam(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return opts, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be a positive number", name))
+			}
+			*size = uint(n)
+		}
+	}
+
+	return opts, nil
+}
+
+// runExec copies between the session and the WebSocket until the command
+// exits or the client disconnects, in which case the session is closed to
+// hang up the command
+func runExec(session *metricus.ExecSession, conn *execConn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	copied := make(chan error, 1)
+	go func() {
+		copied <- session.Copy(conn.stream(execStdout), conn.stream(execStderr))
+	}()
+
+	go func() {
+		defer session.Close()
+		readExec(ctx, session, conn.ws)
+	}()
+
+	ping := time.NewTicker(execPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case err := <-copied:
+			if err != nil {
+				log.Debug().Err(err).Str("exec", session.ID).Msg("exec output ended")
+			}
+			sendExecExit(ctx, session, conn)
+			return
+		case <-ping.C:
+			if err := conn.write(websocket.PingMessage, nil); err != nil {
+				session.Close()
+			}
+		}
+	}
+}
+
+// readExec forwards client frames to the session until the WebSocket fails
+func readExec(ctx context.Context, session *metricus.ExecSession, ws *websocket.Conn) {
+	ws.SetReadDeadline(time.Now().Add(execPongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(execPongWait))
+	})
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(execPongWait))
+
+		if messageType == websocket.BinaryMessage {
+			if _, err := session.Write(data); err != nil {
+				return
+			}
+			continue
+		}
+
+		var message execMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.Debug().Err(err).Str("exec", session.ID).Msg("invalid exec message")
+			continue
+		}
+		switch message.Type {
+		case "stdin":
+			if _, err := session.Write([]byte(message.Data)); err != nil {
+				return
+			}
+		case "resize":
+			if message.Rows > 0 && message.Cols > 0 {
+				if err := session.Resize(ctx, message.Rows, message.Cols); err != nil {
+					log.Debug().Err(err).Str("exec", session.ID).Msg("error resizing exec")
+				}
+			}
+		case "close":
+			session.CloseStdin()
+		}
+	}
+}
+
+func sendExecExit(ctx context.Context, session *metricus.ExecSession, conn *execConn) {
+	message := execMessage{Type: "exit"}
+	// docker marks the command exited shortly after its output ends
+	for i := 0; i < 10; i++ {
+		code, running, err := session.ExitCode(ctx)
+		if err != nil {
+			break
+		}
+		if !running {
+			message.ExitCode = &code
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	if err := conn.write(websocket.TextMessage, data); err != nil {
+		return
+	}
+	conn.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
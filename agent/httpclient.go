@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"errors"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -24,6 +25,10 @@ func NewSturdyHTTPClient() *SturdyClient {
 			SetRetryWaitTime(APIRetryBackoff).
 			SetRetryMaxWaitTime(MaxAPIRetryBackoff).
 			AddRetryCondition(func(r *resty.Response, err error) bool {
+				if errors.Is(err, errBodyTooLarge) {
+					// The same oversized response would come back again
+					return false
+				}
 				if err != nil {
 					// If there's an error at the network level, always retry
 					return true
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const DefaultSubscriberBufferSize = 16
+
+// Hub fans every published message out to all current subscribers. Publishing
+// never blocks: when a subscriber's buffer is full the oldest queued message
+// is dropped to make room for the newest one.
+type Hub struct {
+	bufferSize int
+
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives messages published to a Hub on C until it is closed
+type Subscription struct {
+	C <-chan []byte
+
+	ch      chan []byte
+	hub     *Hub
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+func NewHub(bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriberBufferSize
+	}
+
+	return &Hub{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers a new subscriber with a bounded buffer
+func (h *Hub) Subscribe() *Subscription {
+	ch := make(chan []byte, h.bufferSize)
+	sub := &Subscription{C: ch, ch: ch, hub: h}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+// Publish delivers msg to every subscriber without blocking
+func (h *Hub) Publish(msg []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		sub.offer(msg)
+	}
+}
+
+// Len returns the number of active subscribers
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.subscribers)
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Close removes the subscription from its hub and closes C
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.unsubscribe(s)
+	})
+}
+
+// Dropped returns how many messages were discarded because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// offer is only called while the hub's read lock is held, so the channel
+// cannot be closed underneath it
+func (s *Subscription) offer(msg []byte) {
+	for {
+		select {
+		case s.ch <- msg:
+			return
+		default:
+		}
+
+		// buffer is full, drop the oldest message and try again
+		select {
+		case <-s.ch:
+			s.dropped.Add(1)
+		default:
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// MetricNameLabel holds the metric name of a series
+	MetricNameLabel = "__name__"
+	// InstanceLabel identifies the target a series was scraped from
+	InstanceLabel = "instance"
+	// JobLabel groups the targets of one discovery source, unless the target
+	// brings its own
+	JobLabel = "job"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Labels is a set of labels sorted by name
+type Labels []Label
+
+// Sample is a single value of a series at a timestamp in milliseconds
+type Sample struct {
+	Labels Labels
+	T      int64
+	V      float64
+}
+
+func LabelsFromMap(m map[string]string) Labels {
+	ls := make(Labels, 0, len(m))
+	for name, value := range m {
+		ls = append(ls, Label{Name: name, Value: value})
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+
+	return ls
+}
+
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+
+	return ""
+}
+
+func (ls Labels) Has(name string) bool {
+	for _, l := range ls {
+		if l.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ls Labels) Map() map[string]string {
+	m := make(map[string]string, len(ls))
+	for _, l := range ls {
+		m[l.Name] = l.Value
+	}
+
+	return m
+}
+
+// Hash returns a hash of the label set usable as a series identity
+func (ls Labels) Hash() uint64 {
+	h := xxhash.New()
+	for _, l := range ls {
+		h.WriteString(l.Name)
+		h.Write([]byte{0xff})
+		h.WriteString(l.Value)
+		h.Write([]byte{0xff})
+	}
+
+	return h.Sum64()
+}
+
+func (ls Labels) Copy() Labels {
+	return append(Labels(nil), ls...)
+}
+
+func (ls Labels) Equal(other Labels) bool {
+	if len(ls) != len(other) {
+		return false
+	}
+	for i := range ls {
+		if ls[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String formats the labels as name{label="value", ...}
+func (ls Labels) String() string {
+	var b strings.Builder
+	b.WriteString(ls.Get(MetricNameLabel))
+	b.WriteByte('{')
+
+	first := true
+	for _, l := range ls {
+		if l.Name == MetricNameLabel {
+			continue
+		}
+		if !first {
+			b.WriteString(", ")
+		}
+		first = false
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func (ls Labels) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ls.Map())
+}
+
+func (ls *Labels) UnmarshalJSON(data []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*ls = LabelsFromMap(m)
+
+	return nil
+}
+
+// LabelsBuilder accumulates changes to a label set
+type LabelsBuilder struct {
+	labels map[string]string
+}
+
+func NewLabelsBuilder(base Labels) *LabelsBuilder {
+	return &LabelsBuilder{labels: base.Map()}
+}
+
+func (b *LabelsBuilder) Get(name string) string {
+	return b.labels[name]
+}
+
+// Set sets a label, an empty value deletes it
+func (b *LabelsBuilder) Set(name, value string) *LabelsBuilder {
+	if value == "" {
+		delete(b.labels, name)
+		return b
+	}
+	b.labels[name] = value
+
+	return b
+}
+
+func (b *LabelsBuilder) Del(name string) *LabelsBuilder {
+	delete(b.labels, name)
+	return b
+}
+
+func (b *LabelsBuilder) Labels() Labels {
+	return LabelsFromMap(b.labels)
+}
+
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+
+	return "?"
+}
+
+// Matcher selects series by the value of one label. A missing label matches
+// as the empty string.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+		}
+		m.re = re
+	}
+
+	return m, nil
+}
+
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+func (m *Matcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// MatchLabels reports whether every matcher matches the label set
+func MatchLabels(ls Labels, matchers ...*Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+// logCollectorResync is how often the collector looks for containers it does
+// not follow yet
+const logCollectorResync = 10 * time.Second
+
+type LogCollectorOptions struct {
+	// Labels select the containers whose logs are stored, "key" or
+	// "key=value", all running containers when empty
+	Labels []string
+}
+
+// LogCollector follows the logs of running containers into a LogStore and
+// LogMetrics, either may be nil. A container is followed from the newest line
+// it was followed up to or stored, or from when the collector started, so
+// that a restarted container's earlier lines are not collected again.
+type LogCollector struct {
+	Options LogCollectorOptions
+
+	docker  *metricus.DockerService
+	store   *LogStore
+	metrics *LogMetrics
+	started time.Time
+
+	mu        sync.Mutex
+	following map[string]bool
+	// last is the time of the newest line collected per container
+	last map[string]time.Time
+	wg   sync.WaitGroup
+}
+
+func NewLogCollector(docker *metricus.DockerService, store *LogStore, metrics *LogMetrics, opts LogCollectorOptions) *LogCollector {
+	return &LogCollector{
+		Options:   opts,
+		docker:    docker,
+		store:     store,
+		metrics:   metrics,
+		following: make(map[string]bool),
+		last:      make(map[string]time.Time),
+	}
+}
+
+func (c *LogCollector) Run(ctx context.Context) {
+	c.started = time.Now()
+
+	ticker := time.NewTicker(logCollectorResync)
+	defer ticker.Stop()
+
+	for {
+		if err := c.resync(ctx); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("error listing containers to collect logs from")
+		}
+
+		select {
+		case <-ctx.Done():
+			c.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *LogCollector) resync(ctx context.Context) error {
+	containers, err := c.docker.GetContainersByLabel(ctx, c.Options.Labels...)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, container := range containers {
+		if c.following[container.ID] {
+			continue
+		}
+		c.following[container.ID] = true
+
+		c.wg.Add(1)
+		go func(container types.Container) {
+			defer c.wg.Done()
+			c.follow(ctx, container)
+
+			c.mu.Lock()
+			delete(c.following, container.ID)
+			c.mu.Unlock()
+		}(container)
+	}
+
+	return nil
+}
+
+// follow stores the container's lines until its logs end, which they do when
+// it stops
+func (c *LogCollector) follow(ctx context.Context, container types.Container) {
+	id, name := shortID(container.ID), containerName(container)
+
+	since := c.started
+	c.mu.Lock()
+	last, ok := c.last[id]
+	c.mu.Unlock()
+	if !ok && c.store != nil {
+		last, ok = c.store.Last(id)
+	}
+	if ok {
+		since = last.Add(time.Nanosecond)
+	}
+
+	lines := make(chan metricus.LogLine)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		errs <- c.docker.StreamLogs(ctx, container.ID, metricus.LogsOptions{
+			Since:      fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+			Tail:       "all",
+			Stdout:     true,
+			Stderr:     true,
+			Timestamps: true,
+		}, lines)
+	}()
+
+	for line := range lines {
+		if line.Timestamp.IsZero() {
+			line.Timestamp = time.Now()
+		}
+		last = line.Timestamp
+		if c.metrics != nil {
+			c.metrics.Observe(container, line)
+		}
+		if c.store == nil {
+			continue
+		}
+		c.store.Append(StoredLog{
+			Time:          line.Timestamp,
+			ContainerID:   id,
+			ContainerName: name,
+			Image:         container.Image,
+			Stream:        line.Stream,
+			Line:          line.Line,
+		})
+	}
+
+	if !last.IsZero() {
+		c.mu.Lock()
+		c.last[id] = last
+		c.mu.Unlock()
+	}
+
+	if err := <-errs; err != nil {
+		log.Warn().Err(err).Str("container", id).Msg("error following container logs")
+	}
+}
@@ -0,0 +1,317 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	LogMetricCounter   = "counter"
+	LogMetricHistogram = "histogram"
+
+	// logMetricsInterval is how often the log metric series are appended
+	logMetricsInterval = 10 * time.Second
+	// logMetricIdle drops series that have not changed for this long, e.g.
+	// of removed containers
+	logMetricIdle = time.Hour
+)
+
+// DefaultLogMetricBuckets are the histogram buckets without configured ones
+var DefaultLogMetricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LogMetricConfig turns matching log lines into a counter increment or a
+// histogram observation. Lines are matched by Regex, or by the JSON or logfmt
+// Field, equal to Equals when set. The series carry the labels of the
+// container, Labels, and the values of the LabelsFrom regex groups or fields.
+type LogMetricConfig struct {
+	Name string `yaml:"name"`
+	// Type is counter, the default, or histogram
+	Type   string `yaml:"type"`
+	Regex  string `yaml:"regex"`
+	Field  string `yaml:"field"`
+	Equals string `yaml:"equals"`
+	// Container is a regex the container name must match
+	Container string `yaml:"container"`
+	// ValueFrom is the regex group or field holding the observed value of a
+	// histogram, or the increment of a counter instead of 1
+	ValueFrom string `yaml:"value_from"`
+	// Scale multiplies the value, e.g. 0.001 for milliseconds to seconds
+	Scale      float64           `yaml:"scale"`
+	Buckets    []float64         `yaml:"buckets"`
+	Labels     map[string]string `yaml:"labels"`
+	LabelsFrom []string          `yaml:"labels_from"`
+
+	regex     *regexp.Regexp
+	container *regexp.Regexp
+}
+
+// Compile validates the rule and compiles its regexes. It must be called
+// before the rule is used.
+func (c *LogMetricConfig) Compile() error {
+	switch {
+	case !metricNameRE.MatchString(c.Name):
+		return fmt.Errorf("invalid metric name %q", c.Name)
+	case (c.Regex == "") == (c.Field == ""):
+		return fmt.Errorf("exactly one of regex or field is required")
+	case c.Equals != "" && c.Field == "":
+		return fmt.Errorf("equals requires field")
+	}
+
+	switch c.Type {
+	case "":
+		c.Type = LogMetricCounter
+	case LogMetricCounter:
+	case LogMetricHistogram:
+		if c.ValueFrom == "" {
+			return fmt.Errorf("histogram requires value_from")
+		}
+		if len(c.Buckets) == 0 {
+			c.Buckets = DefaultLogMetricBuckets
+		}
+		if !sort.Float64sAreSorted(c.Buckets) {
+			return fmt.Errorf("buckets must be in increasing order")
+		}
+	default:
+		return fmt.Errorf("invalid type %q, must be counter or histogram", c.Type)
+	}
+	if c.Scale == 0 {
+		c.Scale = 1
+	}
+
+	if c.Regex != "" {
+		re, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %w", c.Regex, err)
+		}
+		c.regex = re
+
+		for _, name := range append([]string{c.ValueFrom}, c.LabelsFrom...) {
+			if name != "" && re.SubexpIndex(name) < 0 {
+				return fmt.Errorf("regex has no group %q", name)
+			}
+		}
+	}
+	if c.Container != "" {
+		re, err := regexp.Compile("^(?:" + c.Container + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid container regex %q: %w", c.Container, err)
+		}
+		c.container = re
+	}
+
+	for name := range c.Labels {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	for _, name := range c.LabelsFrom {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("labels_from %q is not a valid label name", name)
+		}
+	}
+
+	return nil
+}
+
+// CompileLogMetrics compiles every log metric rule
+func CompileLogMetrics(rules []*LogMetricConfig) error {
+	kinds := make(map[string]string)
+	for i, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		// rules may share a name to count different lines into one metric
+		if kind, ok := kinds[rule.Name]; ok && kind != rule.Type {
+			return fmt.Errorf("rule %d: %q is already a %s", i, rule.Name, kind)
+		}
+		kinds[rule.Name] = rule.Type
+	}
+
+	return nil
+}
+
+// match returns the named values of the line the rule matches
+func (c *LogMetricConfig) match(line string, fields func() map[string]any) (map[string]string, bool) {
+	if c.regex != nil {
+		m := c.regex.FindStringSubmatch(line)
+		if m == nil {
+			return nil, false
+		}
+		values := make(map[string]string)
+		for i, name := range c.regex.SubexpNames() {
+			if name != "" {
+				values[name] = m[i]
+			}
+		}
+		return values, true
+	}
+
+	fs := fields()
+	value, ok := fs[c.Field]
+	if !ok || (c.Equals != "" && fieldString(value) != c.Equals) {
+		return nil, false
+	}
+	values := make(map[string]string, len(fs))
+	for name, value := range fs {
+		values[name] = fieldString(value)
+	}
+
+	return values, true
+}
+
+type logMetricSeries struct {
+	labels  Labels
+	value   float64
+	updated time.Time
+}
+
+// LogMetrics evaluates the log metric rules on every collected line and
+// appends the resulting series, like scraped counters and histograms, to the
+// appender
+type LogMetrics struct {
+	rules    []*LogMetricConfig
+	appender Appender
+
+	mu     sync.Mutex
+	series map[uint64]*logMetricSeries
+}
+
+func NewLogMetrics(rules []*LogMetricConfig, appender Appender) *LogMetrics {
+	return &LogMetrics{
+		rules:    rules,
+		appender: appender,
+		series:   make(map[uint64]*logMetricSeries),
+	}
+}
+
+// Observe applies the rules to a line of the container
+func (m *LogMetrics) Observe(container types.Container, line metricus.LogLine) {
+	var (
+		fields map[string]any
+		parsed bool
+	)
+	parseFields := func() map[string]any {
+		if !parsed {
+			fields, _, _ = parseLogFields(line.Line)
+			parsed = true
+		}
+		return fields
+	}
+
+	base := containerLabels(container)
+	for _, rule := range m.rules {
+		if rule.container != nil && !rule.container.MatchString(base.Get(ContainerNameLabel)) {
+			continue
+		}
+		values, ok := rule.match(line.Line, parseFields)
+		if !ok {
+			continue
+		}
+
+		value := 1.0
+		if rule.ValueFrom != "" {
+			v, err := strconv.ParseFloat(values[rule.ValueFrom], 64)
+			if err != nil || math.IsNaN(v) {
+				continue
+			}
+			value = v * rule.Scale
+		}
+
+		lb := NewLabelsBuilder(base)
+		for name, v := range rule.Labels {
+			lb.Set(name, v)
+		}
+		for _, name := range rule.LabelsFrom {
+			lb.Set(name, values[name])
+		}
+
+		if rule.Type == LogMetricCounter {
+			if value < 0 {
+				continue
+			}
+			m.add(lb.Set(MetricNameLabel, rule.Name).Labels(), value)
+			continue
+		}
+
+		// every bucket is added to, with 0 above the value, so that all of
+		// them exist
+		lb.Set(MetricNameLabel, rule.Name+"_bucket")
+		for _, le := range rule.Buckets {
+			m.add(lb.Set("le", formatFloat(le)).Labels(), boolValue(value <= le))
+		}
+		m.add(lb.Set("le", "+Inf").Labels(), 1)
+		lb.Del("le")
+		m.add(lb.Set(MetricNameLabel, rule.Name+"_sum").Labels(), value)
+		m.add(lb.Set(MetricNameLabel, rule.Name+"_count").Labels(), 1)
+	}
+}
+
+func (m *LogMetrics) add(labels Labels, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.get(labels)
+	s.value += v
+}
+
+// get must be called with m.mu held
+func (m *LogMetrics) get(labels Labels) *logMetricSeries {
+	h := labels.Hash()
+	s, ok := m.series[h]
+	if !ok {
+		s = &logMetricSeries{labels: labels}
+		m.series[h] = s
+	}
+	s.updated = time.Now()
+
+	return s
+}
+
+// Run appends the current value of every series until ctx is cancelled
+func (m *LogMetrics) Run(ctx context.Context) {
+	ticker := time.NewTicker(logMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			samples := m.samples(now)
+			if len(samples) == 0 {
+				continue
+			}
+			if err := m.appender.Append(samples); err != nil {
+				log.Error().Err(err).Msg("error appending log metrics")
+			}
+		}
+	}
+}
+
+func (m *LogMetrics) samples(now time.Time) []Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	samples := make([]Sample, 0, len(m.series))
+	for h, s := range m.series {
+		if now.Sub(s.updated) > logMetricIdle {
+			delete(m.series, h)
+			continue
+		}
+		samples = append(samples, Sample{Labels: s.labels, T: now.UnixMilli(), V: s.value})
+	}
+
+	return samples
+}
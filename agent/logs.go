@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	timetypes "github.com/docker/docker/api/types/time"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/labstack/echo/v4"
+)
+
+// Number of lines returned from the end of the logs without a tail parameter
+const (
+	DefaultLogTail       = "100"
+	DefaultStreamLogTail = "15"
+)
+
+// logsOptions reads the since, until, tail, timestamps, stdout and stderr
+// query parameters. Both streams and timestamps are included by default.
+func logsOptions(c echo.Context, defaultTail string) (metricus.LogsOptions, error) {
+	opts := metricus.LogsOptions{
+		Since:      c.QueryParam("since"),
+		Until:      c.QueryParam("until"),
+		Tail:       c.QueryParam("tail"),
+		Stdout:     true,
+		Stderr:     true,
+		Timestamps: true,
+	}
+
+	for name, value := range map[string]string{"since": opts.Since, "until": opts.Until} {
+		if value == "" {
+			continue
+		}
+		if _, err := timetypes.GetTimestamp(value, time.Now()); err != nil {
+			return opts, echo.NewHTTPError(http.StatusBadRequest, name+" must be a time, a unix timestamp or a duration")
+		}
+	}
+
+	if opts.Tail == "" {
+		opts.Tail = defaultTail
+	} else if n, err := strconv.Atoi(opts.Tail); opts.Tail != "all" && (err != nil || n < 0) {
+		return opts, echo.NewHTTPError(http.StatusBadRequest, "tail must be a number of lines or all")
+	}
+
+	for name, value := range map[string]*bool{"stdout": &opts.Stdout, "stderr": &opts.Stderr, "timestamps": &opts.Timestamps} {
+		if param := c.QueryParam(name); param != "" {
+			b, err := strconv.ParseBool(param)
+			if err != nil {
+				return opts, echo.NewHTTPError(http.StatusBadRequest, name+" must be true or false")
+			}
+			*value = b
+		}
+	}
+	if !opts.Stdout && !opts.Stderr {
+		return opts, echo.NewHTTPError(http.StatusBadRequest, "at least one of stdout and stderr is required")
+	}
+
+	return opts, nil
+}
+
+// DefaultLogMatchLimit is the number of matched lines returned by a search of
+// historical logs without a limit parameter
+const DefaultLogMatchLimit = 1000
+
+// Log levels from least to most severe
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// logLevelAliases maps the level names and abbreviations of common loggers to
+// logLevels
+var logLevelAliases = map[string]string{
+	"trace": "trace", "trc": "trace",
+	"debug": "debug", "dbg": "debug",
+	"info": "info", "inf": "info", "notice": "info",
+	"warn": "warn", "warning": "warn", "wrn": "warn",
+	"error": "error", "err": "error", "erro": "error",
+	"fatal": "fatal", "ftl": "fatal", "panic": "fatal", "critical": "fatal", "crit": "fatal",
+}
+
+// logLevelRE finds the level of an unstructured line, written as a word such
+// as ERROR or [warn], or as level=info
+var logLevelRE = regexp.MustCompile(`(?i)(?:\blevel=|\b)(trace|trc|debug|dbg|info|inf|notice|warn|warning|wrn|error|err|erro|fatal|ftl|panic|critical|crit)\b`)
+
+// detectLogLevel returns the level of the first level word in the line, or an
+// empty string
+func detectLogLevel(line string) string {
+	m := logLevelRE.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+
+	return logLevelAliases[strings.ToLower(m[1])]
+}
+
+func logLevelSeverity(level string) int {
+	return slices.Index(logLevels, level)
+}
+
+// LogEntry is a log line as returned by the log endpoints
+type LogEntry struct {
+	Stream    string     `json:"stream"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Line      string     `json:"line"`
+	Level     string     `json:"level,omitempty"`
+	// Format is json or logfmt for structured lines, whose fields are parsed
+	// into Fields and whose message and time fields, if any, into Message
+	// and Time
+	Format  string         `json:"format,omitempty"`
+	Message string         `json:"message,omitempty"`
+	Time    *time.Time     `json:"time,omitempty"`
+	Fields  map[string]any `json:"fields,omitempty"`
+	// Highlights are the [start, end) offsets of the matches of the search in
+	// Line, in UTF-16 code units like JavaScript string indexes
+	Highlights [][2]int `json:"highlights,omitempty"`
+}
+
+// LogFilter selects log lines server side. Lines must contain Substring,
+// ignoring case, match Regex, be at least as severe as MinLevel and match all
+// of the field matchers.
+type LogFilter struct {
+	Substring string
+	Regex     *regexp.Regexp
+	MinLevel  string
+	Fields    []FieldMatcher
+
+	substring *regexp.Regexp
+}
+
+// logFilter reads the q, regex, level and fields query parameters
+func logFilter(c echo.Context) (*LogFilter, error) {
+	f := &LogFilter{Substring: c.QueryParam("q")}
+
+	if pattern := c.QueryParam("regex"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid regex: %s", err))
+		}
+		f.Regex = re
+	}
+
+	if level := c.QueryParam("level"); level != "" {
+		f.MinLevel = logLevelAliases[strings.ToLower(level)]
+		if f.MinLevel == "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("level must be one of %s", strings.Join(logLevels, ", ")))
+		}
+	}
+
+	for _, value := range c.QueryParams()["fields"] {
+		matchers, err := parseFieldMatchers(value)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid fields: %s", err))
+		}
+		f.Fields = append(f.Fields, matchers...)
+	}
+
+	return f, nil
+}
+
+// Empty is true when the filter selects every line
+func (f *LogFilter) Empty() bool {
+	return f.Substring == "" && f.Regex == nil && f.MinLevel == "" && len(f.Fields) == 0
+}
+
+// Match returns the entry of a line the filter selects, with the offsets of
+// the matches
+func (f *LogFilter) Match(line metricus.LogLine) (LogEntry, bool) {
+	entry := LogEntry{Stream: line.Stream, Line: line.Line, Level: detectLogLevel(line.Line)}
+	if !line.Timestamp.IsZero() {
+		entry.Timestamp = &line.Timestamp
+	}
+	structureLogEntry(&entry)
+
+	if f.MinLevel != "" && logLevelSeverity(entry.Level) < logLevelSeverity(f.MinLevel) {
+		return entry, false
+	}
+	for _, m := range f.Fields {
+		if !m.Matches(&entry) {
+			return entry, false
+		}
+	}
+
+	var matches [][2]int
+	if f.Substring != "" {
+		if f.substring == nil {
+			// lowering may change the byte length of some characters, so
+			// search case insensitively with a literal regex instead
+			f.substring = regexp.MustCompile("(?i)" + regexp.QuoteMeta(f.Substring))
+		}
+		found := f.substring.FindAllStringIndex(line.Line, -1)
+		if found == nil {
+			return entry, false
+		}
+		for _, m := range found {
+			matches = append(matches, [2]int{m[0], m[1]})
+		}
+	}
+	if f.Regex != nil {
+		found := f.Regex.FindAllStringIndex(line.Line, -1)
+		if found == nil {
+			return entry, false
+		}
+		for _, m := range found {
+			if m[0] < m[1] {
+				matches = append(matches, [2]int{m[0], m[1]})
+			}
+		}
+	}
+	entry.Highlights = utf16Ranges(line.Line, mergeRanges(matches))
+
+	return entry, true
+}
+
+// mergeRanges sorts ranges and merges the overlapping ones
+func mergeRanges(ranges [][2]int) [][2]int {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// utf16Ranges converts sorted byte offsets of s to UTF-16 offsets
+func utf16Ranges(s string, ranges [][2]int) [][2]int {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	offsets := make(map[int]int, 2*len(ranges))
+	for _, r := range ranges {
+		offsets[r[0]], offsets[r[1]] = 0, 0
+	}
+	units := 0
+	for i, r := range s {
+		if _, ok := offsets[i]; ok {
+			offsets[i] = units
+		}
+		units += utf16.RuneLen(r)
+	}
+	if _, ok := offsets[len(s)]; ok {
+		offsets[len(s)] = units
+	}
+
+	converted := make([][2]int, len(ranges))
+	for i, r := range ranges {
+		converted[i] = [2]int{offsets[r[0]], offsets[r[1]]}
+	}
+
+	return converted
+}
@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// mergeLogDelay is how long lines are held to be sorted with the lines
+	// other containers logged at the same time
+	mergeLogDelay = 250 * time.Millisecond
+	// maxMergeBuffer releases lines early when this many are held
+	maxMergeBuffer = 1000
+)
+
+// logColors are the colors of the containers of a merged stream, by color key
+var logColors = []string{
+	"#60a5fa", "#f87171", "#4ade80", "#facc15", "#c084fc", "#fb923c",
+	"#2dd4bf", "#f472b6", "#a3e635", "#818cf8", "#fbbf24", "#22d3ee",
+}
+
+// ContainerLogEntry is a log line of one of the containers of a merged stream.
+// ColorKey is the same for all lines of a container and differs between
+// containers while there are enough colors.
+type ContainerLogEntry struct {
+	ContainerID   string `json:"containerId"`
+	ContainerName string `json:"containerName"`
+	ColorKey      int    `json:"colorKey"`
+	Color         string `json:"color"`
+	LogEntry
+}
+
+type mergedLine struct {
+	entry   ContainerLogEntry
+	line    metricus.LogLine
+	arrived time.Time
+}
+
+// mergedLines is a heap of lines by timestamp
+type mergedLines []mergedLine
+
+func (h mergedLines) Len() int           { return len(h) }
+func (h mergedLines) Less(i, j int) bool { return h[i].line.Timestamp.Before(h[j].line.Timestamp) }
+func (h mergedLines) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergedLines) Push(x any)        { *h = append(*h, x.(mergedLine)) }
+func (h *mergedLines) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeContainerLogs follows the logs of the containers and sends the lines
+// the filter matches interleaved by timestamp, until ctx is cancelled or all
+// of the containers stop
+func mergeContainerLogs(ctx context.Context, docker *metricus.DockerService, containers []types.Container, opts metricus.LogsOptions, filter *LogFilter, send func(ContainerLogEntry) error) error {
+	// lines are ordered by their docker timestamp
+	opts.Timestamps = true
+
+	sort.Slice(containers, func(i, j int) bool { return containerName(containers[i]) < containerName(containers[j]) })
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lines := make(chan mergedLine)
+	var wg sync.WaitGroup
+	for i, container := range containers {
+		meta := ContainerLogEntry{
+			ContainerID:   shortID(container.ID),
+			ContainerName: containerName(container),
+			ColorKey:      i % len(logColors),
+			Color:         logColors[i%len(logColors)],
+		}
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			stream := make(chan metricus.LogLine)
+			go func() {
+				defer close(stream)
+				if err := docker.StreamLogs(ctx, id, opts, stream); err != nil {
+					log.Warn().Err(err).Str("container", meta.ContainerID).Msg("error streaming container logs")
+				}
+			}()
+
+			for line := range stream {
+				select {
+				case <-ctx.Done():
+				case lines <- mergedLine{entry: meta, line: line, arrived: time.Now()}:
+				}
+			}
+		}(container.ID)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	ticker := time.NewTicker(mergeLogDelay / 5)
+	defer ticker.Stop()
+
+	var held mergedLines
+	release := func(all bool) error {
+		cutoff := time.Now().Add(-mergeLogDelay)
+		for held.Len() > 0 && (all || held.Len() > maxMergeBuffer || !held[0].arrived.After(cutoff)) {
+			m := heap.Pop(&held).(mergedLine)
+			entry, ok := filter.Match(m.line)
+			if !ok {
+				continue
+			}
+			m.entry.LogEntry = entry
+			if err := send(m.entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-lines:
+			if !ok {
+				return release(true)
+			}
+			heap.Push(&held, m)
+			if held.Len() > maxMergeBuffer {
+				if err := release(false); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := release(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// selectContainers returns the containers whose ID starts with or whose name
+// equals one of ids
+func selectContainers(containers []types.Container, ids []string) []types.Container {
+	var selected []types.Container
+	for _, container := range containers {
+		for _, id := range ids {
+			if strings.HasPrefix(container.ID, id) || containerName(container) == strings.TrimPrefix(id, "/") {
+				selected = append(selected, container)
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return shortID(container.ID)
+	}
+
+	return strings.TrimPrefix(container.Names[0], "/")
+}
@@ -0,0 +1,249 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Formats of structured log lines
+const (
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// Field names the level, message and time of a structured line are read from,
+// in order of preference
+var (
+	logLevelFields   = []string{"level", "lvl", "severity", "log.level", "@level"}
+	logMessageFields = []string{"msg", "message", "@message"}
+	logTimeFields    = []string{"time", "ts", "timestamp", "@timestamp", "t"}
+)
+
+// parseLogFields parses a JSON object or logfmt line into its fields. Nested
+// JSON objects are flattened into dotted keys. ok is false for unstructured
+// lines.
+func parseLogFields(line string) (fields map[string]any, format string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") {
+		var object map[string]any
+		if err := json.Unmarshal([]byte(trimmed), &object); err != nil {
+			return nil, "", false
+		}
+		fields = make(map[string]any, len(object))
+		flattenFields(fields, "", object)
+		return fields, LogFormatJSON, true
+	}
+
+	pairs, err := parseLogfmt(trimmed)
+	if err != nil || len(pairs) == 0 {
+		return nil, "", false
+	}
+	fields = make(map[string]any, len(pairs))
+	for _, p := range pairs {
+		fields[p.key] = p.value
+	}
+
+	return fields, LogFormatLogfmt, true
+}
+
+func flattenFields(fields map[string]any, prefix string, object map[string]any) {
+	for key, value := range object {
+		if nested, ok := value.(map[string]any); ok {
+			flattenFields(fields, prefix+key+".", nested)
+			continue
+		}
+		fields[prefix+key] = value
+	}
+}
+
+type logfmtPair struct {
+	key   string
+	value string
+}
+
+// parseLogfmt parses key=value pairs separated by spaces, values may be double
+// quoted. A line with any other token is not logfmt.
+func parseLogfmt(s string) ([]logfmtPair, error) {
+	var pairs []logfmtPair
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == '\t' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && s[i] != ' ' && s[i] != '"' {
+			i++
+		}
+		if i == start || i == len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("expected key=value at %d", start)
+		}
+		key := s[start:i]
+		if strings.IndexFunc(key, isLogfmtKeyRune) >= 0 {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		i++
+
+		var value string
+		if i < len(s) && s[i] == '"' {
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted value of %s", key)
+			}
+			unquoted, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value of %s: %w", key, err)
+			}
+			value, i = unquoted, end+1
+		} else {
+			start := i
+			for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+				i++
+			}
+			value = s[start:i]
+		}
+
+		pairs = append(pairs, logfmtPair{key: key, value: value})
+	}
+
+	return pairs, nil
+}
+
+// isLogfmtKeyRune is true for runes keys cannot have
+func isLogfmtKeyRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_.-@!", r)
+}
+
+// firstField returns the first of the names present in fields
+func firstField(fields map[string]any, names []string) (any, bool) {
+	for _, name := range names {
+		if value, ok := fields[name]; ok {
+			return value, true
+		}
+	}
+
+	return nil, false
+}
+
+// fieldString formats a field value for display and comparisons
+func fieldString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case float64:
+		return formatFloat(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// parseLogTime reads RFC 3339 times and unix times in seconds or, when too
+// large to be seconds, milliseconds
+func parseLogTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return parseLogTime(f)
+		}
+	case float64:
+		if v > 1e11 {
+			v /= 1000
+		}
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), true
+	}
+
+	return time.Time{}, false
+}
+
+// structureLogEntry sets the fields, format, level, message and time of a
+// structured entry
+func structureLogEntry(entry *LogEntry) {
+	fields, format, ok := parseLogFields(entry.Line)
+	if !ok {
+		return
+	}
+	entry.Fields, entry.Format = fields, format
+
+	if value, ok := firstField(fields, logLevelFields); ok {
+		if level := logLevelAliases[strings.ToLower(fieldString(value))]; level != "" {
+			entry.Level = level
+		}
+	}
+	if value, ok := firstField(fields, logMessageFields); ok {
+		entry.Message = fieldString(value)
+	}
+	if value, ok := firstField(fields, logTimeFields); ok {
+		if t, ok := parseLogTime(value); ok {
+			entry.Time = &t
+		}
+	}
+}
+
+// FieldMatcher compares a field of structured lines with a value
+type FieldMatcher struct {
+	Name     string
+	Value    string
+	NotEqual bool
+}
+
+// parseFieldMatchers parses space separated name=value and name!=value terms,
+// with logfmt quoting, e.g. `level=error service=billing msg!="retrying"`
+func parseFieldMatchers(s string) ([]FieldMatcher, error) {
+	pairs, err := parseLogfmt(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := make([]FieldMatcher, 0, len(pairs))
+	for _, p := range pairs {
+		name, notEqual := strings.CutSuffix(p.key, "!")
+		if name == "" || strings.Contains(name, "!") {
+			return nil, fmt.Errorf("invalid field name %q", p.key)
+		}
+		matchers = append(matchers, FieldMatcher{Name: name, Value: p.value, NotEqual: notEqual})
+	}
+
+	return matchers, nil
+}
+
+// Matches compares the field of the entry. The level field is compared by
+// level, so level=error also matches ERR and "severity":"error".
+func (m FieldMatcher) Matches(entry *LogEntry) bool {
+	var (
+		value string
+		found bool
+	)
+	if m.Name == "level" {
+		value, found = entry.Level, entry.Level != ""
+		if level := logLevelAliases[strings.ToLower(m.Value)]; level != "" {
+			return (found && value == level) != m.NotEqual
+		}
+	} else if v, ok := entry.Fields[m.Name]; ok {
+		value, found = fieldString(v), true
+	}
+
+	return (found && value == m.Value) != m.NotEqual
+}
@@ -0,0 +1,584 @@
+package agent
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultLogRetention     = 7 * 24 * time.Hour
+	DefaultLogFlushInterval = 5 * time.Second
+
+	// logPartition is the time span of one partition file
+	logPartition = time.Hour
+	// logPartitionLayout names partition files after their start in UTC
+	logPartitionLayout = "20060102T15"
+	// maxPendingLogs flushes early when this many lines are buffered
+	maxPendingLogs = 10000
+)
+
+type LogStoreOptions struct {
+	Path          string
+	Retention     time.Duration
+	FlushInterval time.Duration
+}
+
+// StoredLog is a log line of a container as stored
+type StoredLog struct {
+	Time          time.Time `json:"t"`
+	ContainerID   string    `json:"c"`
+	ContainerName string    `json:"n"`
+	Image         string    `json:"i,omitempty"`
+	Stream        string    `json:"s"`
+	Line          string    `json:"l"`
+}
+
+// StoredLogContainer is what the index knows about a container's stored logs
+type StoredLogContainer struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	Image string    `json:"image,omitempty"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	Lines int       `json:"lines"`
+}
+
+// logPartitionIndex lists the containers of a partition so that queries for
+// a container skip the partitions without it
+type logPartitionIndex struct {
+	Containers map[string]*StoredLogContainer `json:"containers"`
+}
+
+// LogStore keeps container logs in hourly partitions under Path. Lines are
+// buffered in memory and every flush appends them to their partition as a
+// gzip member, with the containers of the partition in a JSON index next to
+// it:
+//
+//	<start>.log.gz    gzip members of JSON lines
+//	<start>.idx.json  containers and their time range
+//
+// Lines buffered when the agent stops abruptly are lost.
+type LogStore struct {
+	Options LogStoreOptions
+
+	// writeMu serializes flushes and retention
+	writeMu sync.Mutex
+	// unsaved are the partitions whose lines were written but not their
+	// index, guarded by writeMu
+	unsaved map[time.Time]bool
+
+	mu      sync.RWMutex
+	pending []StoredLog
+	index   map[time.Time]*logPartitionIndex
+
+	flushCh chan struct{}
+	stopCh  chan struct{}
+	done    chan struct{}
+}
+
+// OpenLogStore opens or creates the log store at opts.Path and loads the
+// index of its partitions
+func OpenLogStore(opts LogStoreOptions) (*LogStore, error) {
+	if opts.Retention <= 0 {
+		opts.Retention = DefaultLogRetention
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultLogFlushInterval
+	}
+	if err := os.MkdirAll(opts.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed creating log store dir: %w", err)
+	}
+
+	s := &LogStore{
+		Options: opts,
+		index:   make(map[time.Time]*logPartitionIndex),
+		unsaved: make(map[time.Time]bool),
+		flushCh: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(opts.Path, "*.idx.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		start, err := time.Parse(logPartitionLayout, strings.TrimSuffix(filepath.Base(path), ".idx.json"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading log index: %w", err)
+		}
+		idx := &logPartitionIndex{}
+		if err := json.Unmarshal(data, idx); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("skipping corrupt log index")
+			continue
+		}
+		s.index[start] = idx
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Append buffers lines until the next flush
+func (s *LogStore) Append(logs ...StoredLog) {
+	s.mu.Lock()
+	s.pending = append(s.pending, logs...)
+	full := len(s.pending) >= maxPendingLogs
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Last returns the time of the newest stored line of the container
+func (s *LogStore) Last(containerID string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last time.Time
+	for _, idx := range s.index {
+		if c, ok := idx.Containers[containerID]; ok && c.Last.After(last) {
+			last = c.Last
+		}
+	}
+	for _, l := range s.pending {
+		if l.ContainerID == containerID && l.Time.After(last) {
+			last = l.Time
+		}
+	}
+
+	return last, !last.IsZero()
+}
+
+// Containers returns every container with stored logs, most recent first
+func (s *LogStore) Containers() []StoredLogContainer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	merged := make(map[string]*StoredLogContainer)
+	add := func(c StoredLogContainer) {
+		m, ok := merged[c.ID]
+		if !ok {
+			merged[c.ID] = &c
+			return
+		}
+		if c.First.Before(m.First) {
+			m.First = c.First
+		}
+		if c.Last.After(m.Last) {
+			m.Last, m.Name, m.Image = c.Last, c.Name, c.Image
+		}
+		m.Lines += c.Lines
+	}
+	for _, idx := range s.index {
+		for _, c := range idx.Containers {
+			add(*c)
+		}
+	}
+	for _, l := range s.pending {
+		add(StoredLogContainer{ID: l.ContainerID, Name: l.ContainerName, Image: l.Image, First: l.Time, Last: l.Time, Lines: 1})
+	}
+
+	containers := make([]StoredLogContainer, 0, len(merged))
+	for _, c := range merged {
+		containers = append(containers, *c)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Last.After(containers[j].Last) })
+
+	return containers
+}
+
+// LogQuery selects stored lines between From and To of the containers whose
+// ID starts with or whose name equals one of Containers, all containers when
+// empty, that Filter matches
+type LogQuery struct {
+	From       time.Time
+	To         time.Time
+	Containers []string
+	Filter     *LogFilter
+	// Limit keeps the most recent matches, zero keeps all
+	Limit int
+}
+
+// StoredLogEntry is a matched stored line
+type StoredLogEntry struct {
+	ContainerID   string `json:"containerId"`
+	ContainerName string `json:"containerName"`
+	Image         string `json:"image,omitempty"`
+	LogEntry
+}
+
+// Query returns the matching lines oldest first and the number of matches
+// before the limit was applied
+func (s *LogStore) Query(q LogQuery) ([]StoredLogEntry, int, error) {
+	if q.Filter == nil {
+		q.Filter = &LogFilter{}
+	}
+	selected := func(id, name string) bool {
+		if len(q.Containers) == 0 {
+			return true
+		}
+		for _, c := range q.Containers {
+			if strings.HasPrefix(id, shortID(c)) || name == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the partition sizes are taken with the pending lines under writeMu and
+	// only read up to, so that a flush neither duplicates nor drops lines of
+	// the query
+	s.writeMu.Lock()
+	s.mu.RLock()
+	var partitions []time.Time
+	for start, idx := range s.index {
+		if start.Add(logPartition).Before(q.From) || start.After(q.To) {
+			continue
+		}
+		for _, c := range idx.Containers {
+			if selected(c.ID, c.Name) {
+				partitions = append(partitions, start)
+				break
+			}
+		}
+	}
+	pending := append([]StoredLog(nil), s.pending...)
+	s.mu.RUnlock()
+
+	sizes := make(map[time.Time]int64, len(partitions))
+	for _, start := range partitions {
+		info, err := os.Stat(s.partitionPath(start, ".log.gz"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.writeMu.Unlock()
+			return nil, 0, fmt.Errorf("failed reading log partition: %w", err)
+		}
+		if info != nil {
+			sizes[start] = info.Size()
+		}
+	}
+	s.writeMu.Unlock()
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Before(partitions[j]) })
+
+	var (
+		entries []StoredLogEntry
+		matched int
+	)
+	match := func(l StoredLog) {
+		if l.Time.Before(q.From) || l.Time.After(q.To) || !selected(l.ContainerID, l.ContainerName) {
+			return
+		}
+		entry, ok := q.Filter.Match(metricus.LogLine{Stream: l.Stream, Timestamp: l.Time, Line: l.Line})
+		if !ok {
+			return
+		}
+		matched++
+		entries = append(entries, StoredLogEntry{ContainerID: l.ContainerID, ContainerName: l.ContainerName, Image: l.Image, LogEntry: entry})
+		if q.Limit > 0 && len(entries) > q.Limit {
+			entries = entries[1:]
+		}
+	}
+
+	// partitions are decoded one at a time, and as lines within a partition
+	// are in flush order, sorted before matching
+	for _, start := range partitions {
+		var logs []StoredLog
+		err := s.readLogPartition(start, sizes[start], func(l StoredLog) { logs = append(logs, l) })
+		if err != nil {
+			return nil, 0, err
+		}
+		sortStoredLogs(logs)
+		for _, l := range logs {
+			match(l)
+		}
+	}
+	sortStoredLogs(pending)
+	for _, l := range pending {
+		match(l)
+	}
+
+	if entries == nil {
+		entries = []StoredLogEntry{}
+	}
+	return entries, matched, nil
+}
+
+func sortStoredLogs(logs []StoredLog) {
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Time.Before(logs[j].Time) })
+}
+
+func (s *LogStore) partitionPath(start time.Time, ext string) string {
+	return filepath.Join(s.Options.Path, start.UTC().Format(logPartitionLayout)+ext)
+}
+
+// readLogPartition decodes the lines of the first size bytes of a partition
+// file. A partition deleted by retention since has no lines.
+func (s *LogStore) readLogPartition(start time.Time, size int64, fn func(StoredLog)) error {
+	if size == 0 {
+		return nil
+	}
+
+	f, err := os.Open(s.partitionPath(start, ".log.gz"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed reading log partition: %w", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(io.LimitReader(f, size)))
+	if err != nil {
+		return fmt.Errorf("failed reading log partition: %w", err)
+	}
+	defer zr.Close()
+
+	br := bufio.NewReader(zr)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var l StoredLog
+			if jsonErr := json.Unmarshal(line, &l); jsonErr == nil {
+				fn(l)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// keep what was read before a truncated member
+			log.Warn().Err(err).Msg("error reading log partition")
+			return nil
+		}
+	}
+}
+
+func (s *LogStore) run() {
+	defer close(s.done)
+
+	flush := time.NewTicker(s.Options.FlushInterval)
+	defer flush.Stop()
+	retention := time.NewTicker(retentionCheckInterval)
+	defer retention.Stop()
+
+	s.applyRetention()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-flush.C:
+		case <-s.flushCh:
+		case <-retention.C:
+			s.applyRetention()
+			continue
+		}
+		if err := s.Flush(); err != nil {
+			log.Error().Err(err).Msg("log store flush failed")
+		}
+	}
+}
+
+// Flush writes the buffered lines to their partitions and the indexes a
+// previous flush failed to write
+func (s *LogStore) Flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	for start := range s.unsaved {
+		if err := s.writeIndex(start); err != nil {
+			return err
+		}
+		delete(s.unsaved, start)
+	}
+
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	partitions := make(map[time.Time][]StoredLog)
+	for _, l := range pending {
+		start := l.Time.UTC().Truncate(logPartition)
+		partitions[start] = append(partitions[start], l)
+	}
+
+	for start, logs := range partitions {
+		if err := s.writePartition(start, logs); err != nil {
+			// keep the lines of every partition not written for the next
+			// flush, the failed one included unless only its index failed
+			if errors.Is(err, errLogIndexUnsaved) {
+				delete(partitions, start)
+			}
+			var unwritten []StoredLog
+			for _, logs := range partitions {
+				unwritten = append(unwritten, logs...)
+			}
+			s.mu.Lock()
+			s.pending = append(unwritten, s.pending...)
+			s.mu.Unlock()
+			return err
+		}
+		delete(partitions, start)
+	}
+
+	return nil
+}
+
+// errLogIndexUnsaved is returned by writePartition when the lines were
+// written but not the index, which the next flush writes again
+var errLogIndexUnsaved = errors.New("log index not saved")
+
+// writePartition must be called with writeMu held
+func (s *LogStore) writePartition(start time.Time, logs []StoredLog) error {
+	f, err := os.OpenFile(s.partitionPath(start, ".log.gz"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed opening log partition: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed opening log partition: %w", err)
+	}
+	if err := writeLogMember(f, logs); err != nil {
+		// drop the partial member so the partition stays readable
+		f.Truncate(info.Size())
+		return fmt.Errorf("failed writing log partition: %w", err)
+	}
+
+	s.mu.Lock()
+	idx, ok := s.index[start]
+	if !ok {
+		idx = &logPartitionIndex{Containers: make(map[string]*StoredLogContainer)}
+		s.index[start] = idx
+	}
+	for _, l := range logs {
+		c, ok := idx.Containers[l.ContainerID]
+		if !ok {
+			c = &StoredLogContainer{ID: l.ContainerID, First: l.Time, Last: l.Time}
+			idx.Containers[l.ContainerID] = c
+		}
+		if l.Time.Before(c.First) {
+			c.First = l.Time
+		}
+		if !l.Time.Before(c.Last) {
+			c.Last, c.Name, c.Image = l.Time, l.ContainerName, l.Image
+		}
+		c.Lines++
+	}
+	s.mu.Unlock()
+
+	if err := s.writeIndex(start); err != nil {
+		s.unsaved[start] = true
+		return fmt.Errorf("%w: %w", errLogIndexUnsaved, err)
+	}
+
+	return nil
+}
+
+// writeIndex saves the index of a partition, it must be called with writeMu
+// held
+func (s *LogStore) writeIndex(start time.Time) error {
+	s.mu.RLock()
+	idx, ok := s.index[start]
+	if !ok {
+		// deleted by retention
+		s.mu.RUnlock()
+		return nil
+	}
+	data, err := json.Marshal(idx)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	path := s.partitionPath(start, ".idx.json")
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("failed writing log index: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed writing log index: %w", err)
+	}
+
+	return nil
+}
+
+func writeLogMember(f *os.File, logs []StoredLog) error {
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, l := range logs {
+		if err := enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// applyRetention deletes the partitions that ended before the retention
+// period
+func (s *LogStore) applyRetention() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	cutoff := time.Now().Add(-s.Options.Retention)
+
+	s.mu.Lock()
+	var expired []time.Time
+	for start := range s.index {
+		if start.Add(logPartition).Before(cutoff) {
+			expired = append(expired, start)
+			delete(s.index, start)
+			delete(s.unsaved, start)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, start := range expired {
+		for _, ext := range []string{".log.gz", ".idx.json"} {
+			if err := os.Remove(s.partitionPath(start, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Error().Err(err).Msg("failed deleting expired log partition")
+			}
+		}
+	}
+	if len(expired) > 0 {
+		log.Info().Int("partitions", len(expired)).Msg("deleted expired logs")
+	}
+}
+
+// Close flushes the buffered lines
+func (s *LogStore) Close() error {
+	close(s.stopCh)
+	<-s.done
+
+	return s.Flush()
+}
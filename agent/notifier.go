@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const DefaultWebhookTimeoutSeconds = 10
+
+// WebhookConfig is a receiver that alerts are POSTed to as a WebhookMessage
+type WebhookConfig struct {
+	URL            string `yaml:"url"`
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+}
+
+// WebhookMessage is the JSON body sent to webhook receivers. Status is
+// firing when any of the alerts is firing.
+type WebhookMessage struct {
+	Version string     `json:"version"`
+	Status  AlertState `json:"status"`
+	Alerts  []Alert    `json:"alerts"`
+}
+
+type WebhookNotifier struct {
+	webhooks []WebhookConfig
+	client   *SturdyClient
+}
+
+func NewWebhookNotifier(webhooks []WebhookConfig) *WebhookNotifier {
+	return &WebhookNotifier{
+		webhooks: webhooks,
+		client:   NewSturdyHTTPClient().SetRetryWaitTime(time.Second).SetRetryMaxWaitTime(5 * time.Second),
+	}
+}
+
+// Notify sends the alerts to every webhook and returns the errors of those
+// that failed
+func (n *WebhookNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	msg := WebhookMessage{Version: "1", Status: AlertResolved, Alerts: alerts}
+	for _, alert := range alerts {
+		if alert.State == AlertFiring {
+			msg.Status = AlertFiring
+			break
+		}
+	}
+
+	var errs []error
+	for _, webhook := range n.webhooks {
+		if err := n.send(ctx, webhook, msg); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", webhook.URL, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (n *WebhookNotifier) send(ctx context.Context, webhook WebhookConfig, msg WebhookMessage) error {
+	timeout := webhook.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	resp, err := n.client.R().SetContext(ctx).SetBody(msg).Post(webhook.URL)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("unexpected status %s", resp.Status())
+	}
+
+	return nil
+}
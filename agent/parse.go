@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseSamples decodes a scrape response. Bodies starting with '{' are read
+// as the flat JSON object exposed by the sdk, anything else as the
+// Prometheus text exposition format. Samples without an explicit timestamp
+// get ts (milliseconds).
+func ParseSamples(body []byte, ts int64) ([]Sample, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONSamples(trimmed, ts)
+	}
+
+	return parseTextSamples(trimmed, ts)
+}
+
+func parseJSONSamples(body []byte, ts int64) ([]Sample, error) {
+	var values map[string]any
+	if err := json.Unmarshal(body, &values); err != nil {
+		return nil, fmt.Errorf("failed decoding json metrics: %w", err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	samples := make([]Sample, 0, len(values))
+	for _, name := range names {
+		value, ok := values[name].(float64)
+		if !ok {
+			continue
+		}
+		samples = append(samples, Sample{
+			Labels: Labels{{Name: MetricNameLabel, Value: name}},
+			T:      ts,
+			V:      value,
+		})
+	}
+
+	return samples, nil
+}
+
+func parseTextSamples(body []byte, ts int64) ([]Sample, error) {
+	var samples []Sample
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		sample, err := parseTextLine(line, ts)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+func parseTextLine(line string, ts int64) (Sample, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return Sample{}, fmt.Errorf("missing metric name or value")
+	}
+
+	labels := map[string]string{MetricNameLabel: line[:end]}
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		var err error
+		if rest, err = parseTextLabels(rest[1:], labels); err != nil {
+			return Sample{}, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Sample{}, fmt.Errorf("expected value and optional timestamp, got %q", rest)
+	}
+
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return Sample{}, fmt.Errorf("invalid value %q: %w", fields[0], err)
+	}
+
+	if len(fields) == 2 {
+		if ts, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return Sample{}, fmt.Errorf("invalid timestamp %q: %w", fields[1], err)
+		}
+	}
+
+	return Sample{Labels: LabelsFromMap(labels), T: ts, V: value}, nil
+}
+
+// parseTextLabels reads label pairs up to the closing brace and returns the
+// remainder of the line
+func parseTextLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return "", fmt.Errorf("unterminated label set")
+		}
+		if s[0] == '}' {
+			return s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("invalid label in %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if s == "" || s[0] != '"' {
+			return "", fmt.Errorf("label %q value must be quoted", name)
+		}
+
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", fmt.Errorf("unterminated value for label %q", name)
+		}
+
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
+
+func parseFloat(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,768 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The expression language is a subset of PromQL: instant and range vector
+// selectors with offset, number literals, the sum/avg/min/max/count
+// aggregations with by or without, arithmetic, comparison and set binary
+// operators with bool, on and ignoring, and the functions in promqlFunctions.
+
+type Expr interface {
+	String() string
+}
+
+type NumberLiteral struct {
+	Val float64
+}
+
+type VectorSelector struct {
+	Matchers []*Matcher
+	Offset   time.Duration
+}
+
+type MatrixSelector struct {
+	Vector *VectorSelector
+	Range  time.Duration
+}
+
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Grouping []string
+	Without  bool
+}
+
+type BinaryExpr struct {
+	Op         string
+	LHS, RHS   Expr
+	ReturnBool bool
+	// Matching is set when on() or ignoring() was given
+	Matching *VectorMatching
+}
+
+type VectorMatching struct {
+	On     bool
+	Labels []string
+}
+
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (e *NumberLiteral) String() string { return formatFloat(e.Val) }
+func (e *ParenExpr) String() string     { return "(" + e.Expr.String() + ")" }
+func (e *UnaryExpr) String() string     { return e.Op + e.Expr.String() }
+
+func (e *VectorSelector) String() string {
+	var name string
+	var matchers []string
+	for _, m := range e.Matchers {
+		if m.Name == MetricNameLabel && m.Type == MatchEqual && name == "" {
+			name = m.Value
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+
+	s := name
+	if len(matchers) > 0 || name == "" {
+		s += "{" + strings.Join(matchers, ", ") + "}"
+	}
+	if e.Offset != 0 {
+		s += " offset " + formatDuration(e.Offset)
+	}
+
+	return s
+}
+
+func (e *MatrixSelector) String() string {
+	vs := *e.Vector
+	vs.Offset = 0
+	s := vs.String() + "[" + formatDuration(e.Range) + "]"
+	if e.Vector.Offset != 0 {
+		s += " offset " + formatDuration(e.Vector.Offset)
+	}
+
+	return s
+}
+
+func (e *Call) String() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.String()
+	}
+
+	return e.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (e *AggregateExpr) String() string {
+	s := e.Op
+	if e.Without {
+		s += " without (" + strings.Join(e.Grouping, ", ") + ")"
+	} else if len(e.Grouping) > 0 {
+		s += " by (" + strings.Join(e.Grouping, ", ") + ")"
+	}
+
+	return s + " (" + e.Expr.String() + ")"
+}
+
+func (e *BinaryExpr) String() string {
+	op := e.Op
+	if e.ReturnBool {
+		op += " bool"
+	}
+	if e.Matching != nil {
+		kind := "ignoring"
+		if e.Matching.On {
+			kind = "on"
+		}
+		op += " " + kind + " (" + strings.Join(e.Matching.Labels, ", ") + ")"
+	}
+
+	return e.LHS.String() + " " + op + " " + e.RHS.String()
+}
+
+func formatDuration(d time.Duration) string {
+	ms := d.Milliseconds()
+	units := []struct {
+		suffix string
+		ms     int64
+	}{
+		{"y", 365 * 24 * 3600 * 1000},
+		{"w", 7 * 24 * 3600 * 1000},
+		{"d", 24 * 3600 * 1000},
+		{"h", 3600 * 1000},
+		{"m", 60 * 1000},
+		{"s", 1000},
+		{"ms", 1},
+	}
+
+	if ms == 0 {
+		return "0s"
+	}
+
+	var b strings.Builder
+	for _, u := range units {
+		if n := ms / u.ms; n > 0 {
+			b.WriteString(strconv.FormatInt(n, 10) + u.suffix)
+			ms -= n * u.ms
+		}
+	}
+
+	return b.String()
+}
+
+var aggregationOps = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true,
+}
+
+// binary operator precedence, higher binds tighter
+var binaryPrecedence = map[string]int{
+	"or":  1,
+	"and": 2, "unless": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+	"^": 6,
+}
+
+func isComparisonOp(op string) bool {
+	return binaryPrecedence[op] == 3
+}
+
+func isSetOp(op string) bool {
+	return op == "and" || op == "or" || op == "unless"
+}
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokOp
+	tokLeftParen
+	tokRightParen
+	tokLeftBrace
+	tokRightBrace
+	tokLeftBracket
+	tokRightBracket
+	tokComma
+	tokMatchOp
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+var (
+	durationRE = regexp.MustCompile(`^([0-9]+(ms|[smhdwy]))+`)
+	numberRE   = regexp.MustCompile(`^([0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?|0[xX][0-9a-fA-F]+)`)
+)
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(input); {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case c == '#':
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		}
+
+		start := pos
+		rest := input[pos:]
+		switch {
+		case c == '(':
+			tokens = append(tokens, token{tokLeftParen, "(", start})
+			pos++
+		case c == ')':
+			tokens = append(tokens, token{tokRightParen, ")", start})
+			pos++
+		case c == '{':
+			tokens = append(tokens, token{tokLeftBrace, "{", start})
+			pos++
+		case c == '}':
+			tokens = append(tokens, token{tokRightBrace, "}", start})
+			pos++
+		case c == '[':
+			tokens = append(tokens, token{tokLeftBracket, "[", start})
+			pos++
+		case c == ']':
+			tokens = append(tokens, token{tokRightBracket, "]", start})
+			pos++
+		case c == ',':
+			tokens = append(tokens, token{tokComma, ",", start})
+			pos++
+		case strings.HasPrefix(rest, "=~") || strings.HasPrefix(rest, "!~"):
+			tokens = append(tokens, token{tokMatchOp, rest[:2], start})
+			pos += 2
+		case strings.HasPrefix(rest, "==") || strings.HasPrefix(rest, "!=") ||
+			strings.HasPrefix(rest, "<=") || strings.HasPrefix(rest, ">="):
+			tokens = append(tokens, token{tokOp, rest[:2], start})
+			pos += 2
+		case c == '=':
+			tokens = append(tokens, token{tokMatchOp, "=", start})
+			pos++
+		case strings.ContainsRune("+-*/%^<>", rune(c)):
+			tokens = append(tokens, token{tokOp, string(c), start})
+			pos++
+		case c == '"' || c == '\'' || c == '`':
+			value, remaining, err := unquotePrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("at position %d: %w", start, err)
+			}
+			tokens = append(tokens, token{tokString, value, start})
+			pos = len(input) - len(remaining)
+		case c >= '0' && c <= '9' || c == '.':
+			if m := durationRE.FindString(rest); m != "" && !isIdentifierByte(rest, len(m)) {
+				tokens = append(tokens, token{tokDuration, m, start})
+				pos += len(m)
+				break
+			}
+			m := numberRE.FindString(rest)
+			if m == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, start)
+			}
+			tokens = append(tokens, token{tokNumber, m, start})
+			pos += len(m)
+		case c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := pos + 1
+			for isIdentifierByte(input, end) {
+				end++
+			}
+			word := input[pos:end]
+			typ := tokIdent
+			if _, ok := binaryPrecedence[strings.ToLower(word)]; ok {
+				typ, word = tokOp, strings.ToLower(word)
+			}
+			tokens = append(tokens, token{typ, word, start})
+			pos = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, start)
+		}
+	}
+
+	return append(tokens, token{tokEOF, "", len(input)}), nil
+}
+
+func isIdentifierByte(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	c := s[i]
+
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// ParseDuration parses a PromQL duration such as 5m or 1h30m
+func ParseDuration(s string) (time.Duration, error) {
+	if !durationRE.MatchString(s) || durationRE.FindString(s) != s {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+
+	var d time.Duration
+	for _, part := range regexp.MustCompile(`[0-9]+(ms|[smhdwy])`).FindAllStringSubmatch(s, -1) {
+		n, err := strconv.ParseInt(strings.TrimSuffix(part[0], part[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		d += time.Duration(n) * units[part[1]]
+	}
+
+	return d, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseExpr parses a query expression
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.val, tok.pos)
+	}
+
+	return expr, nil
+}
+
+// ParseSelector parses a series selector such as
+// http_requests_total{method="GET", code=~"5.."}
+func ParseSelector(input string) ([]*Matcher, error) {
+	expr, err := ParseExpr(input)
+	if err != nil {
+		return nil, err
+	}
+
+	vs, ok := expr.(*VectorSelector)
+	if !ok || vs.Offset != 0 {
+		return nil, fmt.Errorf("%q is not a series selector", input)
+	}
+
+	return vs.Matchers, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+func (p *parser) expect(typ tokenType, what string) (token, error) {
+	tok := p.next()
+	if tok.typ != typ {
+		if tok.typ == tokEOF {
+			return tok, fmt.Errorf("unexpected end of input, expected %s", what)
+		}
+		return tok, fmt.Errorf("unexpected %q at position %d, expected %s", tok.val, tok.pos, what)
+	}
+
+	return tok, nil
+}
+
+// parseExpr is a precedence climbing parser over binary operators
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec, ok := binaryPrecedence[tok.val]
+		if tok.typ != tokOp || !ok || prec <= minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		expr := &BinaryExpr{Op: tok.val, LHS: lhs}
+		if p.peek().typ == tokIdent && p.peek().val == "bool" {
+			if !isComparisonOp(tok.val) {
+				return nil, fmt.Errorf("bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			expr.ReturnBool = true
+		}
+		if next := p.peek(); next.typ == tokIdent && (next.val == "on" || next.val == "ignoring") {
+			p.next()
+			labels, err := p.parseLabelList()
+			if err != nil {
+				return nil, err
+			}
+			expr.Matching = &VectorMatching{On: next.val == "on", Labels: labels}
+		}
+		if next := p.peek(); next.typ == tokIdent && (next.val == "group_left" || next.val == "group_right") {
+			return nil, fmt.Errorf("%s is not supported", next.val)
+		}
+
+		// ^ is right associative, everything else left associative
+		rhsPrec := prec
+		if tok.val == "^" {
+			rhsPrec = prec - 1
+		}
+		if expr.RHS, err = p.parseExpr(rhsPrec); err != nil {
+			return nil, err
+		}
+
+		lt, rt := exprType(expr.LHS), exprType(expr.RHS)
+		switch {
+		case lt == typeMatrix || rt == typeMatrix:
+			return nil, fmt.Errorf("binary operator %s cannot be applied to a range vector", tok.val)
+		case lt == typeScalar && rt == typeScalar && isComparisonOp(tok.val) && !expr.ReturnBool:
+			return nil, fmt.Errorf("comparisons between scalars must use the bool modifier")
+		case (lt == typeScalar || rt == typeScalar) && isSetOp(tok.val):
+			return nil, fmt.Errorf("set operator %s not allowed between a scalar and a vector", tok.val)
+		case expr.Matching != nil && (lt == typeScalar || rt == typeScalar):
+			return nil, fmt.Errorf("vector matching only allowed between instant vectors")
+		}
+		lhs = expr
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if tok := p.peek(); tok.typ == tokOp && (tok.val == "-" || tok.val == "+") {
+		p.next()
+		// unary operators bind looser than ^ so that -2^2 is -4
+		expr, err := p.parseExpr(binaryPrecedence["*"])
+		if err != nil {
+			return nil, err
+		}
+		if tok.val == "+" {
+			return expr, nil
+		}
+		if n, ok := expr.(*NumberLiteral); ok {
+			return &NumberLiteral{Val: -n.Val}, nil
+		}
+		return &UnaryExpr{Op: "-", Expr: expr}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().typ == tokLeftBracket {
+		vs, ok := expr.(*VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("ranges are only allowed on vector selectors")
+		}
+		p.next()
+		tok, err := p.expect(tokDuration, "range duration")
+		if err != nil {
+			return nil, err
+		}
+		rng, err := ParseDuration(tok.val)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRightBracket, "]"); err != nil {
+			return nil, err
+		}
+		expr = &MatrixSelector{Vector: vs, Range: rng}
+	}
+
+	if tok := p.peek(); tok.typ == tokIdent && tok.val == "offset" {
+		p.next()
+		tok, err := p.expect(tokDuration, "offset duration")
+		if err != nil {
+			return nil, err
+		}
+		offset, err := ParseDuration(tok.val)
+		if err != nil {
+			return nil, err
+		}
+
+		switch e := expr.(type) {
+		case *VectorSelector:
+			e.Offset = offset
+		case *MatrixSelector:
+			e.Vector.Offset = offset
+		default:
+			return nil, fmt.Errorf("offset is only allowed on selectors")
+		}
+	}
+
+	return expr, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.next()
+	switch tok.typ {
+	case tokNumber:
+		v, err := parseNumber(tok.val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok.val)
+		}
+		return &NumberLiteral{Val: v}, nil
+	case tokLeftParen:
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRightParen, ")"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case tokLeftBrace:
+		p.pos--
+		return p.parseSelector("")
+	case tokIdent:
+		switch {
+		case strings.EqualFold(tok.val, "inf") || strings.EqualFold(tok.val, "nan"):
+			v, _ := parseFloat(map[string]string{"inf": "+Inf", "nan": "NaN"}[strings.ToLower(tok.val)])
+			return &NumberLiteral{Val: v}, nil
+		case aggregationOps[tok.val]:
+			return p.parseAggregation(tok.val)
+		case p.peek().typ == tokLeftParen:
+			return p.parseCall(tok)
+		}
+		return p.parseSelector(tok.val)
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of input")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.val, tok.pos)
+}
+
+func parseNumber(s string) (float64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseInt(s[2:], 16, 64)
+		return float64(n), err
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+func (p *parser) parseSelector(name string) (Expr, error) {
+	vs := &VectorSelector{}
+	if name != "" {
+		vs.Matchers = append(vs.Matchers, &Matcher{Type: MatchEqual, Name: MetricNameLabel, Value: name})
+	}
+
+	if p.peek().typ == tokLeftBrace {
+		p.next()
+		for p.peek().typ != tokRightBrace {
+			label := p.next()
+			if label.typ != tokIdent && label.typ != tokOp {
+				return nil, fmt.Errorf("unexpected %q at position %d, expected label name", label.val, label.pos)
+			}
+			op := p.next()
+			typ, ok := map[string]MatchType{"=": MatchEqual, "!=": MatchNotEqual, "=~": MatchRegexp, "!~": MatchNotRegexp}[op.val]
+			if !ok {
+				return nil, fmt.Errorf("unexpected %q at position %d, expected label match operator", op.val, op.pos)
+			}
+			value, err := p.expect(tokString, "quoted label value")
+			if err != nil {
+				return nil, err
+			}
+
+			m, err := NewMatcher(typ, label.val, value.val)
+			if err != nil {
+				return nil, err
+			}
+			vs.Matchers = append(vs.Matchers, m)
+
+			if p.peek().typ == tokComma {
+				p.next()
+			} else if p.peek().typ != tokRightBrace {
+				return nil, fmt.Errorf("unexpected %q at position %d, expected , or }", p.peek().val, p.peek().pos)
+			}
+		}
+		p.next()
+	}
+
+	// a selector matching the empty string everywhere would select every series
+	for _, m := range vs.Matchers {
+		if !m.Matches("") {
+			return vs, nil
+		}
+	}
+
+	return nil, fmt.Errorf("vector selector must contain at least one non-empty matcher")
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokLeftParen, "("); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for p.peek().typ != tokRightParen {
+		tok := p.next()
+		if tok.typ != tokIdent && tok.typ != tokOp {
+			return nil, fmt.Errorf("unexpected %q at position %d, expected label name", tok.val, tok.pos)
+		}
+		labels = append(labels, tok.val)
+
+		if p.peek().typ == tokComma {
+			p.next()
+		} else if p.peek().typ != tokRightParen {
+			return nil, fmt.Errorf("unexpected %q at position %d, expected , or )", p.peek().val, p.peek().pos)
+		}
+	}
+	p.next()
+
+	return labels, nil
+}
+
+func (p *parser) parseAggregation(op string) (Expr, error) {
+	agg := &AggregateExpr{Op: op}
+
+	parseGrouping := func() error {
+		tok := p.peek()
+		if tok.typ != tokIdent || (tok.val != "by" && tok.val != "without") {
+			return nil
+		}
+		p.next()
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return err
+		}
+		agg.Grouping, agg.Without = labels, tok.val == "without"
+		return nil
+	}
+
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokLeftParen, "("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokRightParen, ")"); err != nil {
+		return nil, err
+	}
+	agg.Expr = expr
+
+	if agg.Grouping == nil {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	return agg, nil
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	fn, ok := promqlFunctions[name.val]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.val, name.pos)
+	}
+	p.next()
+
+	call := &Call{Func: name.val}
+	for p.peek().typ != tokRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		if p.peek().typ == tokComma {
+			p.next()
+		} else if p.peek().typ != tokRightParen {
+			return nil, fmt.Errorf("unexpected %q at position %d, expected , or )", p.peek().val, p.peek().pos)
+		}
+	}
+	p.next()
+
+	if len(call.Args) != len(fn.args) {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name.val, len(fn.args), len(call.Args))
+	}
+	for i, want := range fn.args {
+		if got := exprType(call.Args[i]); got != want {
+			return nil, fmt.Errorf("%s argument %d must be a %s, got %s", name.val, i+1, want, got)
+		}
+	}
+
+	return call, nil
+}
+
+// Value types of expressions
+const (
+	typeScalar = "scalar"
+	typeVector = "instant vector"
+	typeMatrix = "range vector"
+)
+
+func exprType(e Expr) string {
+	switch e := e.(type) {
+	case *NumberLiteral:
+		return typeScalar
+	case *MatrixSelector:
+		return typeMatrix
+	case *ParenExpr:
+		return exprType(e.Expr)
+	case *UnaryExpr:
+		return exprType(e.Expr)
+	case *BinaryExpr:
+		if exprType(e.LHS) == typeScalar && exprType(e.RHS) == typeScalar {
+			return typeScalar
+		}
+		return typeVector
+	case *Call:
+		return promqlFunctions[e.Func].returns
+	}
+
+	return typeVector
+}
@@ -0,0 +1,572 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Queryable is the sample storage expressions are evaluated against
+type Queryable interface {
+	Select(mint, maxt int64, matchers ...*Matcher) ([]Series, error)
+}
+
+// Value is the result of evaluating an expression: a Scalar, a Vector or,
+// for range queries and range selectors, a Matrix
+type Value interface {
+	Type() string
+}
+
+type Scalar Point
+
+type Vector []VectorSample
+
+type Matrix []MatrixSeries
+
+func (Scalar) Type() string { return "scalar" }
+func (Vector) Type() string { return "vector" }
+func (Matrix) Type() string { return "matrix" }
+
+func (s Scalar) MarshalJSON() ([]byte, error) {
+	return Point(s).MarshalJSON()
+}
+
+// Engine evaluates query expressions against a Queryable
+type Engine struct {
+	storage Queryable
+}
+
+func NewEngine(storage Queryable) *Engine {
+	return &Engine{storage: storage}
+}
+
+// Instant evaluates the query at ts
+func (e *Engine) Instant(query string, ts time.Time) (Value, error) {
+	expr, err := ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.InstantExpr(expr, ts)
+}
+
+// InstantExpr evaluates a parsed expression at ts
+func (e *Engine) InstantExpr(expr Expr, ts time.Time) (Value, error) {
+	ev, err := e.newEvaluator(expr, ts.UnixMilli(), ts.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := ev.eval(expr, ts.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	if vector, ok := v.(Vector); ok {
+		if err := checkDuplicateSeries(vector); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// Range evaluates the query at every step between start and end. The step
+// must be at least a millisecond and give at most maxRangePoints steps.
+func (e *Engine) Range(query string, start, end time.Time, step time.Duration) (Matrix, error) {
+	startMs, endMs, stepMs := start.UnixMilli(), end.UnixMilli(), step.Milliseconds()
+	if stepMs <= 0 {
+		return nil, fmt.Errorf("step must be at least 1ms")
+	}
+	if (endMs-startMs)/stepMs > maxRangePoints {
+		return nil, fmt.Errorf("range of %s at step %s exceeds %d points", end.Sub(start), step, maxRangePoints)
+	}
+
+	expr, err := ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	if t := exprType(expr); t != typeScalar && t != typeVector {
+		return nil, fmt.Errorf("range queries require an instant vector or scalar expression, got %s", t)
+	}
+
+	ev, err := e.newEvaluator(expr, startMs, endMs)
+	if err != nil {
+		return nil, err
+	}
+
+	series := map[uint64]*MatrixSeries{}
+	var order []uint64
+	for ts := startMs; ts <= endMs; ts += stepMs {
+		v, err := ev.eval(expr, ts)
+		if err != nil {
+			return nil, err
+		}
+
+		var vector Vector
+		switch v := v.(type) {
+		case Scalar:
+			vector = Vector{{Point: Point(v)}}
+		case Vector:
+			vector = v
+		}
+		if err := checkDuplicateSeries(vector); err != nil {
+			return nil, err
+		}
+
+		for _, sample := range vector {
+			h := sample.Metric.Hash()
+			s, ok := series[h]
+			if !ok {
+				s = &MatrixSeries{Metric: sample.Metric}
+				series[h] = s
+				order = append(order, h)
+			}
+			s.Points = append(s.Points, sample.Point)
+		}
+	}
+
+	matrix := make(Matrix, 0, len(order))
+	for _, h := range order {
+		matrix = append(matrix, *series[h])
+	}
+	sort.Slice(matrix, func(i, j int) bool { return compareLabels(matrix[i].Metric, matrix[j].Metric) < 0 })
+
+	return matrix, nil
+}
+
+// checkDuplicateSeries fails results with several samples of one label set,
+// e.g. rate() over two metrics that only differ by name
+func checkDuplicateSeries(vector Vector) error {
+	if len(vector) < 2 {
+		return nil
+	}
+
+	seen := make(map[uint64]bool, len(vector))
+	for _, sample := range vector {
+		h := sample.Metric.Hash()
+		if seen[h] {
+			return fmt.Errorf("vector cannot contain metrics with the same labelset %s", sample.Metric)
+		}
+		seen[h] = true
+	}
+
+	return nil
+}
+
+// evaluator holds the series of every selector of an expression, loaded once
+// for the whole evaluation range
+type evaluator struct {
+	series map[*VectorSelector][]Series
+}
+
+func (e *Engine) newEvaluator(expr Expr, start, end int64) (*evaluator, error) {
+	ev := &evaluator{series: map[*VectorSelector][]Series{}}
+
+	var err error
+	walkExpr(expr, func(node Expr) {
+		if err != nil {
+			return
+		}
+
+		var vs *VectorSelector
+		lookback := LookbackDelta.Milliseconds()
+		switch n := node.(type) {
+		case *VectorSelector:
+			vs = n
+		case *MatrixSelector:
+			vs, lookback = n.Vector, n.Range.Milliseconds()
+		default:
+			return
+		}
+
+		offset := vs.Offset.Milliseconds()
+		ev.series[vs], err = e.storage.Select(start-offset-lookback, end-offset, vs.Matchers...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed selecting series: %w", err)
+	}
+
+	return ev, nil
+}
+
+func walkExpr(expr Expr, fn func(Expr)) {
+	fn(expr)
+
+	switch e := expr.(type) {
+	case *ParenExpr:
+		walkExpr(e.Expr, fn)
+	case *UnaryExpr:
+		walkExpr(e.Expr, fn)
+	case *AggregateExpr:
+		walkExpr(e.Expr, fn)
+	case *BinaryExpr:
+		walkExpr(e.LHS, fn)
+		walkExpr(e.RHS, fn)
+	case *Call:
+		for _, arg := range e.Args {
+			walkExpr(arg, fn)
+		}
+	case *MatrixSelector:
+		// the vector selector of a range is loaded with the range, not the lookback
+	}
+}
+
+func (ev *evaluator) eval(expr Expr, ts int64) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{T: ts, V: e.Val}, nil
+	case *ParenExpr:
+		return ev.eval(e.Expr, ts)
+	case *VectorSelector:
+		return ev.vectorSelector(e, ts), nil
+	case *MatrixSelector:
+		return ev.matrixSelector(e, ts), nil
+	case *UnaryExpr:
+		v, err := ev.eval(e.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case Scalar:
+			return Scalar{T: ts, V: -v.V}, nil
+		case Vector:
+			out := make(Vector, 0, len(v))
+			for _, s := range v {
+				out = append(out, VectorSample{Metric: dropMetricName(s.Metric), Point: Point{T: ts, V: -s.Point.V}})
+			}
+			return out, nil
+		}
+	case *AggregateExpr:
+		v, err := ev.eval(e.Expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		vector, ok := v.(Vector)
+		if !ok {
+			return nil, fmt.Errorf("%s expects an instant vector, got %s", e.Op, exprType(e.Expr))
+		}
+		return aggregate(e, vector, ts), nil
+	case *BinaryExpr:
+		lhs, err := ev.eval(e.LHS, ts)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(e.RHS, ts)
+		if err != nil {
+			return nil, err
+		}
+		return binaryOp(e, lhs, rhs, ts)
+	case *Call:
+		args := make([]Value, len(e.Args))
+		for i, arg := range e.Args {
+			v, err := ev.eval(arg, ts)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		return promqlFunctions[e.Func].call(args, e, ts), nil
+	}
+
+	return nil, fmt.Errorf("unsupported expression %s", expr)
+}
+
+// vectorSelector returns the latest sample within the lookback delta of
+// every selected series
+func (ev *evaluator) vectorSelector(vs *VectorSelector, ts int64) Vector {
+	refTime := ts - vs.Offset.Milliseconds()
+
+	vector := Vector{}
+	for _, s := range ev.series[vs] {
+		i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > refTime })
+		if i == 0 || refTime-s.Points[i-1].T > LookbackDelta.Milliseconds() {
+			continue
+		}
+		vector = append(vector, VectorSample{Metric: s.Labels, Point: Point{T: ts, V: s.Points[i-1].V}})
+	}
+
+	return vector
+}
+
+// matrixSelector returns the samples in (ts-range, ts] of every selected series
+func (ev *evaluator) matrixSelector(ms *MatrixSelector, ts int64) Matrix {
+	maxt := ts - ms.Vector.Offset.Milliseconds()
+	mint := maxt - ms.Range.Milliseconds()
+
+	matrix := Matrix{}
+	for _, s := range ev.series[ms.Vector] {
+		lo := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > mint })
+		hi := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].T > maxt })
+		if lo >= hi {
+			continue
+		}
+		matrix = append(matrix, MatrixSeries{Metric: s.Labels, Points: s.Points[lo:hi]})
+	}
+
+	return matrix
+}
+
+func dropMetricName(ls Labels) Labels {
+	if !ls.Has(MetricNameLabel) {
+		return ls
+	}
+
+	return NewLabelsBuilder(ls).Del(MetricNameLabel).Labels()
+}
+
+func aggregate(e *AggregateExpr, vector Vector, ts int64) Vector {
+	type group struct {
+		labels Labels
+		value  float64
+		count  int
+	}
+
+	groups := map[uint64]*group{}
+	var order []uint64
+	for _, s := range vector {
+		lb := NewLabelsBuilder(nil)
+		if e.Without {
+			lb = NewLabelsBuilder(s.Metric).Del(MetricNameLabel)
+			for _, name := range e.Grouping {
+				lb.Del(name)
+			}
+		} else {
+			for _, name := range e.Grouping {
+				lb.Set(name, s.Metric.Get(name))
+			}
+		}
+		labels := lb.Labels()
+
+		h := labels.Hash()
+		g, ok := groups[h]
+		if !ok {
+			groups[h] = &group{labels: labels, value: s.Point.V, count: 1}
+			order = append(order, h)
+			continue
+		}
+
+		g.count++
+		switch e.Op {
+		case "sum", "avg":
+			g.value += s.Point.V
+		case "min":
+			if s.Point.V < g.value || math.IsNaN(g.value) {
+				g.value = s.Point.V
+			}
+		case "max":
+			if s.Point.V > g.value || math.IsNaN(g.value) {
+				g.value = s.Point.V
+			}
+		}
+	}
+
+	out := make(Vector, 0, len(order))
+	for _, h := range order {
+		g := groups[h]
+		v := g.value
+		switch e.Op {
+		case "avg":
+			v /= float64(g.count)
+		case "count":
+			v = float64(g.count)
+		}
+		out = append(out, VectorSample{Metric: g.labels, Point: Point{T: ts, V: v}})
+	}
+
+	return out
+}
+
+func binaryOp(e *BinaryExpr, lhs, rhs Value, ts int64) (Value, error) {
+	ls, lIsScalar := lhs.(Scalar)
+	rs, rIsScalar := rhs.(Scalar)
+
+	switch {
+	case lIsScalar && rIsScalar:
+		v, keep := scalarOp(e.Op, ls.V, rs.V)
+		if isComparisonOp(e.Op) {
+			v = boolValue(keep)
+		}
+		return Scalar{T: ts, V: v}, nil
+	case lIsScalar || rIsScalar:
+		if isSetOp(e.Op) {
+			return nil, fmt.Errorf("set operator %s not allowed between a scalar and a vector", e.Op)
+		}
+		vector, scalar := lhs, rs.V
+		if lIsScalar {
+			vector, scalar = rhs, ls.V
+		}
+
+		out := Vector{}
+		for _, s := range vector.(Vector) {
+			l, r := s.Point.V, scalar
+			if lIsScalar {
+				l, r = scalar, s.Point.V
+			}
+			v, keep := scalarOp(e.Op, l, r)
+			metric := s.Metric
+			if isComparisonOp(e.Op) {
+				if e.ReturnBool {
+					v, keep = boolValue(keep), true
+				} else {
+					// a filtering comparison keeps the vector's value
+					v = s.Point.V
+				}
+			}
+			if !keep {
+				continue
+			}
+			if !isComparisonOp(e.Op) || e.ReturnBool {
+				metric = dropMetricName(metric)
+			}
+			out = append(out, VectorSample{Metric: metric, Point: Point{T: ts, V: v}})
+		}
+		return out, nil
+	}
+
+	return vectorOp(e, lhs.(Vector), rhs.(Vector), ts)
+}
+
+// vectorOp applies the operator to one-to-one matched samples of two vectors
+func vectorOp(e *BinaryExpr, lhs, rhs Vector, ts int64) (Vector, error) {
+	signature := func(ls Labels) uint64 {
+		if e.Matching != nil && e.Matching.On {
+			lb := NewLabelsBuilder(nil)
+			for _, name := range e.Matching.Labels {
+				lb.Set(name, ls.Get(name))
+			}
+			return lb.Labels().Hash()
+		}
+
+		lb := NewLabelsBuilder(ls).Del(MetricNameLabel)
+		if e.Matching != nil {
+			for _, name := range e.Matching.Labels {
+				lb.Del(name)
+			}
+		}
+		return lb.Labels().Hash()
+	}
+
+	rhsBySig := make(map[uint64]VectorSample, len(rhs))
+	for _, s := range rhs {
+		sig := signature(s.Metric)
+		if _, ok := rhsBySig[sig]; ok && !isSetOp(e.Op) {
+			return nil, fmt.Errorf("many-to-one matching is not supported, found duplicate series for %s on the right-hand side", s.Metric)
+		}
+		rhsBySig[sig] = s
+	}
+
+	out := Vector{}
+	switch e.Op {
+	case "and", "unless":
+		for _, s := range lhs {
+			if _, ok := rhsBySig[signature(s.Metric)]; ok == (e.Op == "and") {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	case "or":
+		lhsSigs := map[uint64]bool{}
+		for _, s := range lhs {
+			lhsSigs[signature(s.Metric)] = true
+			out = append(out, s)
+		}
+		for _, s := range rhs {
+			if !lhsSigs[signature(s.Metric)] {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	}
+
+	matched := map[uint64]bool{}
+	for _, l := range lhs {
+		sig := signature(l.Metric)
+		r, ok := rhsBySig[sig]
+		if !ok {
+			continue
+		}
+		if matched[sig] {
+			return nil, fmt.Errorf("one-to-many matching is not supported, found duplicate series for %s on the left-hand side", l.Metric)
+		}
+		matched[sig] = true
+
+		v, keep := scalarOp(e.Op, l.Point.V, r.Point.V)
+		metric := l.Metric
+		if isComparisonOp(e.Op) {
+			if e.ReturnBool {
+				v, keep = boolValue(keep), true
+			} else {
+				v = l.Point.V
+			}
+		}
+		if !keep {
+			continue
+		}
+		if !isComparisonOp(e.Op) || e.ReturnBool {
+			metric = resultMetric(metric, e.Matching)
+		}
+		out = append(out, VectorSample{Metric: metric, Point: Point{T: ts, V: v}})
+	}
+
+	return out, nil
+}
+
+func resultMetric(ls Labels, matching *VectorMatching) Labels {
+	lb := NewLabelsBuilder(ls).Del(MetricNameLabel)
+	switch {
+	case matching == nil:
+	case matching.On:
+		lb = NewLabelsBuilder(nil)
+		for _, name := range matching.Labels {
+			lb.Set(name, ls.Get(name))
+		}
+	default:
+		for _, name := range matching.Labels {
+			lb.Del(name)
+		}
+	}
+
+	return lb.Labels()
+}
+
+// scalarOp returns the result of an arithmetic operator, or for a comparison
+// whether it holds
+func scalarOp(op string, l, r float64) (float64, bool) {
+	switch op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "%":
+		return math.Mod(l, r), true
+	case "^":
+		return math.Pow(l, r), true
+	case "==":
+		return l, l == r
+	case "!=":
+		return l, l != r
+	case ">":
+		return l, l > r
+	case "<":
+		return l, l < r
+	case ">=":
+		return l, l >= r
+	case "<=":
+		return l, l <= r
+	}
+
+	return math.NaN(), false
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"math"
+	"sort"
+)
+
+type promqlFunction struct {
+	args    []string
+	returns string
+	call    func(args []Value, call *Call, ts int64) Value
+}
+
+var promqlFunctions = map[string]promqlFunction{
+	"rate": {
+		args:    []string{typeMatrix},
+		returns: typeVector,
+		call: func(args []Value, call *Call, ts int64) Value {
+			return extrapolatedRate(args[0].(Matrix), call.Args[0].(*MatrixSelector), ts, true)
+		},
+	},
+	"increase": {
+		args:    []string{typeMatrix},
+		returns: typeVector,
+		call: func(args []Value, call *Call, ts int64) Value {
+			return extrapolatedRate(args[0].(Matrix), call.Args[0].(*MatrixSelector), ts, false)
+		},
+	},
+	"irate": {
+		args:    []string{typeMatrix},
+		returns: typeVector,
+		call: func(args []Value, call *Call, ts int64) Value {
+			return instantRate(args[0].(Matrix), ts)
+		},
+	},
+	"histogram_quantile": {
+		args:    []string{typeScalar, typeVector},
+		returns: typeVector,
+		call: func(args []Value, call *Call, ts int64) Value {
+			return histogramQuantile(args[0].(Scalar).V, args[1].(Vector), ts)
+		},
+	},
+}
+
+// extrapolatedRate computes the increase of counters over the range,
+// treating any decrease as a reset to zero and extrapolating to the range
+// boundaries the way Prometheus does. With isRate it is per second.
+func extrapolatedRate(matrix Matrix, ms *MatrixSelector, ts int64, isRate bool) Vector {
+	rangeEnd := ts - ms.Vector.Offset.Milliseconds()
+	rangeStart := rangeEnd - ms.Range.Milliseconds()
+
+	out := Vector{}
+	for _, s := range matrix {
+		if len(s.Points) < 2 {
+			continue
+		}
+		first, last := s.Points[0], s.Points[len(s.Points)-1]
+
+		result := last.V - first.V
+		prev := first.V
+		for _, p := range s.Points[1:] {
+			if p.V < prev {
+				result += prev
+			}
+			prev = p.V
+		}
+
+		durationToStart := float64(first.T-rangeStart) / 1000
+		durationToEnd := float64(rangeEnd-last.T) / 1000
+		sampledInterval := float64(last.T-first.T) / 1000
+		averageInterval := sampledInterval / float64(len(s.Points)-1)
+
+		// a counter cannot be extrapolated below zero
+		if result > 0 && first.V >= 0 {
+			if durationToZero := sampledInterval * (first.V / result); durationToZero < durationToStart {
+				durationToStart = durationToZero
+			}
+		}
+
+		// extrapolate to a boundary only if it is close to the samples,
+		// otherwise assume the series starts or ends half an interval away
+		threshold := averageInterval * 1.1
+		extrapolated := sampledInterval
+		if durationToStart < threshold {
+			extrapolated += durationToStart
+		} else {
+			extrapolated += averageInterval / 2
+		}
+		if durationToEnd < threshold {
+			extrapolated += durationToEnd
+		} else {
+			extrapolated += averageInterval / 2
+		}
+
+		result *= extrapolated / sampledInterval
+		if isRate {
+			result /= ms.Range.Seconds()
+		}
+
+		out = append(out, VectorSample{Metric: dropMetricName(s.Metric), Point: Point{T: ts, V: result}})
+	}
+
+	return out
+}
+
+// instantRate computes the per second rate from the last two samples
+func instantRate(matrix Matrix, ts int64) Vector {
+	out := Vector{}
+	for _, s := range matrix {
+		if len(s.Points) < 2 {
+			continue
+		}
+		prev, last := s.Points[len(s.Points)-2], s.Points[len(s.Points)-1]
+
+		increase := last.V - prev.V
+		if last.V < prev.V {
+			increase = last.V
+		}
+		interval := float64(last.T-prev.T) / 1000
+		if interval == 0 {
+			continue
+		}
+
+		out = append(out, VectorSample{Metric: dropMetricName(s.Metric), Point: Point{T: ts, V: increase / interval}})
+	}
+
+	return out
+}
+
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramQuantile estimates the q quantile of every histogram in the
+// vector from its cumulative le buckets
+func histogramQuantile(q float64, vector Vector, ts int64) Vector {
+	type histogram struct {
+		labels  Labels
+		buckets []bucket
+	}
+
+	histograms := map[uint64]*histogram{}
+	var order []uint64
+	for _, s := range vector {
+		upperBound, err := parseFloat(s.Metric.Get("le"))
+		if err != nil {
+			continue
+		}
+
+		labels := NewLabelsBuilder(s.Metric).Del(MetricNameLabel).Del("le").Labels()
+		h := labels.Hash()
+		if _, ok := histograms[h]; !ok {
+			histograms[h] = &histogram{labels: labels}
+			order = append(order, h)
+		}
+		histograms[h].buckets = append(histograms[h].buckets, bucket{upperBound: upperBound, count: s.Point.V})
+	}
+
+	out := Vector{}
+	for _, h := range order {
+		hist := histograms[h]
+		out = append(out, VectorSample{Metric: hist.labels, Point: Point{T: ts, V: bucketQuantile(q, hist.buckets)}})
+	}
+
+	return out
+}
+
+// bucketQuantile interpolates linearly within the bucket holding the rank,
+// assuming the lowest bucket starts at zero
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+
+	// scrapes are not atomic, counts of higher buckets can lag behind lower ones
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	total := buckets[len(buckets)-1].count
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var start, count float64
+	end := buckets[b].upperBound
+	if b > 0 {
+		start = buckets[b-1].upperBound
+		count = buckets[b-1].count
+	}
+	bucketCount := buckets[b].count - count
+	if bucketCount == 0 {
+		return start
+	}
+
+	return start + (end-start)*((rank-count)/bucketCount)
+}
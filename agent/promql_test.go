@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// promqlBase is the time of the first sample of testdata/promql/series.txt
+var promqlBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// promqlSeriesInterval is the time between the values of a seeded series
+const promqlSeriesInterval = time.Minute
+
+// openSeededTSDB opens a database holding the series of path, one per line as
+// a selector followed by one value per interval, _ for a missing sample
+func openSeededTSDB(t *testing.T, path string) *TSDB {
+	t.Helper()
+
+	db, err := OpenTSDB(TSDBOptions{Path: t.TempDir(), Retention: 100 * 365 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	lines, err := readCaseLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []Sample
+	for _, line := range lines {
+		end := strings.IndexByte(line, ' ')
+		if i := strings.LastIndexByte(line, '}'); i >= 0 {
+			end = i + 1
+		}
+		matchers, err := ParseSelector(line[:end])
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		lb := NewLabelsBuilder(nil)
+		for _, m := range matchers {
+			lb.Set(m.Name, m.Value)
+		}
+		labels := lb.Labels()
+
+		for i, field := range strings.Fields(line[end:]) {
+			if field == "_" {
+				continue
+			}
+			v, err := parseFloat(field)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			ts := promqlBase.Add(time.Duration(i) * promqlSeriesInterval)
+			samples = append(samples, Sample{Labels: labels, T: ts.UnixMilli(), V: v})
+		}
+	}
+	if err := db.Append(samples); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// readCaseLines returns the lines of a test file without blank lines and
+// # comments
+func readCaseLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// checkGolden compares got with the golden file, or rewrites it with -update
+func checkGolden(t *testing.T, path, got string) {
+	t.Helper()
+
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run the test with -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("result differs from %s, run the test with -update and review the diff\n got:\n%s", path, got)
+	}
+}
+
+func TestPromQLParse(t *testing.T) {
+	queries, err := readCaseLines(filepath.Join("testdata", "promql", "parse.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	for _, query := range queries {
+		fmt.Fprintln(&out, query)
+		expr, err := ParseExpr(query)
+		if err != nil {
+			fmt.Fprintf(&out, "  error: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(&out, "  %s: %s\n", exprType(expr), expr)
+	}
+
+	checkGolden(t, filepath.Join("testdata", "promql", "parse.golden"), out.String())
+}
+
+// TestPromQLEval evaluates the cases of every testdata/promql/eval_*.txt file
+// against the seeded series. A case is either
+//
+//	instant <time> <query>
+//	range <start> <end> <step> <query>
+//
+// with times as durations after the first sample.
+func TestPromQLEval(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "promql", "eval_*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no eval test files")
+	}
+
+	db := openSeededTSDB(t, filepath.Join("testdata", "promql", "series.txt"))
+	engine := NewEngine(db)
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		t.Run(name, func(t *testing.T) {
+			cases, err := readCaseLines(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out strings.Builder
+			for _, c := range cases {
+				fmt.Fprintln(&out, c)
+				result, err := evalCase(engine, c)
+				if err != nil {
+					fmt.Fprintf(&out, "  error: %v\n", err)
+					continue
+				}
+				out.WriteString(result)
+			}
+
+			checkGolden(t, strings.TrimSuffix(file, ".txt")+".golden", out.String())
+		})
+	}
+}
+
+func evalCase(engine *Engine, c string) (string, error) {
+	kind, rest, _ := strings.Cut(c, " ")
+
+	var (
+		times []time.Duration
+		nargs int
+	)
+	switch kind {
+	case "instant":
+		nargs = 1
+	case "range":
+		nargs = 3
+	default:
+		return "", fmt.Errorf("unknown case kind %q", kind)
+	}
+	for i := 0; i < nargs; i++ {
+		var arg string
+		arg, rest, _ = strings.Cut(rest, " ")
+		d, err := ParseDuration(arg)
+		if err != nil {
+			return "", err
+		}
+		times = append(times, d)
+	}
+
+	var out strings.Builder
+	if kind == "instant" {
+		v, err := engine.Instant(rest, promqlBase.Add(times[0]))
+		if err != nil {
+			return "", err
+		}
+		switch v := v.(type) {
+		case Scalar:
+			fmt.Fprintf(&out, "  scalar %s\n", formatFloat(v.V))
+		case Vector:
+			sort.Slice(v, func(i, j int) bool { return compareLabels(v[i].Metric, v[j].Metric) < 0 })
+			for _, s := range v {
+				fmt.Fprintf(&out, "  %s %s\n", s.Metric, formatFloat(s.Point.V))
+			}
+		case Matrix:
+			writeMatrix(&out, v)
+		}
+		return out.String(), nil
+	}
+
+	m, err := engine.Range(rest, promqlBase.Add(times[0]), promqlBase.Add(times[1]), times[2])
+	if err != nil {
+		return "", err
+	}
+	writeMatrix(&out, m)
+
+	return out.String(), nil
+}
+
+func writeMatrix(out *strings.Builder, m Matrix) {
+	for _, s := range m {
+		points := make([]string, len(s.Points))
+		for i, p := range s.Points {
+			at := time.UnixMilli(p.T).Sub(promqlBase)
+			points[i] = formatFloat(p.V) + "@" + formatDuration(at)
+		}
+		fmt.Fprintf(out, "  %s %s\n", s.Metric, strings.Join(points, " "))
+	}
+}
+
+func TestEngineRangeStep(t *testing.T) {
+	db, err := OpenTSDB(TSDBOptions{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	engine := NewEngine(db)
+
+	start := time.Now()
+	tests := []struct {
+		name    string
+		end     time.Time
+		step    time.Duration
+		wantErr string
+	}{
+		{name: "millisecond", end: start.Add(time.Second), step: time.Millisecond},
+		{name: "zero", end: start.Add(time.Second), step: 0, wantErr: "step must be at least 1ms"},
+		{name: "sub-millisecond", end: start.Add(time.Second), step: 500 * time.Microsecond, wantErr: "step must be at least 1ms"},
+		{name: "too many points", end: start.Add(time.Hour), step: 100 * time.Millisecond, wantErr: "range of 1h0m0s at step 100ms exceeds 11000 points"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := engine.Range("1", start, tt.end, tt.step)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// LookbackDelta is how far back an instant query looks for the latest
+	// sample of a series
+	LookbackDelta = 5 * time.Minute
+
+	// maxRangePoints bounds the number of steps of a range query
+	maxRangePoints = 11000
+)
+
+// VectorSample is the value of one series at the query time
+type VectorSample struct {
+	Metric Labels `json:"metric"`
+	Point  Point  `json:"point"`
+}
+
+// MatrixSeries is the values of one series at every step of a range query
+type MatrixSeries struct {
+	Metric Labels  `json:"metric"`
+	Points []Point `json:"points"`
+}
+
+// QueryResult is the JSON body of the query endpoints
+type QueryResult struct {
+	ResultType string `json:"resultType"`
+	Result     any    `json:"result"`
+}
+
+// MarshalJSON writes non-finite values, which JSON numbers cannot hold, as
+// the strings "NaN", "+Inf" and "-Inf"
+func (p Point) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(p.V) || math.IsInf(p.V, 0) {
+		return json.Marshal(struct {
+			T int64  `json:"t"`
+			V string `json:"v"`
+		}{p.T, formatFloat(p.V)})
+	}
+
+	type point Point
+	return json.Marshal(point(p))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// unquotePrefix reads a quoted string at the start of s
+func unquotePrefix(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'' && s[0] != '`') {
+		return "", "", fmt.Errorf("expected quoted string")
+	}
+
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && quote != '`' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			raw := s[:i+1]
+			if quote == '\'' {
+				// strconv only accepts single quotes around one character
+				raw = `"` + strings.ReplaceAll(raw[1:i], `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s: %w", s[:i+1], err)
+			}
+			return value, s[i+1:], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// parseTimeParam accepts unix seconds with optional fraction or RFC3339
+func parseTimeParam(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.UnixMilli(int64(seconds * 1000)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// validateStep rejects steps under a millisecond, the resolution of the
+// samples, and steps giving more than maxRangePoints between start and end
+func validateStep(start, end time.Time, step time.Duration) error {
+	if step < time.Millisecond {
+		return fmt.Errorf("step must be at least 1ms")
+	}
+	if end.Sub(start)/step > maxRangePoints {
+		return fmt.Errorf("range of %s at step %s exceeds %d points", end.Sub(start), step, maxRangePoints)
+	}
+
+	return nil
+}
+
+// parseDurationParam accepts seconds with optional fraction or a Go duration
+func parseDurationParam(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("invalid duration %q", value)
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseRangeParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{name: "seconds step", query: "start=0&end=3600&step=15"},
+		{name: "duration step", query: "start=0&end=3600&step=1m"},
+		{name: "millisecond step", query: "start=0&end=1&step=0.001"},
+		{name: "missing start", query: "end=3600&step=15", wantErr: "start is required"},
+		{name: "end before start", query: "start=60&end=0&step=15", wantErr: "end must not be before start"},
+		{name: "zero step", query: "start=0&end=3600&step=0", wantErr: "step must be at least 1ms"},
+		{name: "negative step", query: "start=0&end=3600&step=-15", wantErr: "step must be at least 1ms"},
+		{name: "sub-millisecond step", query: "start=0&end=1&step=0.0005", wantErr: "step must be at least 1ms"},
+		{name: "too many points", query: "start=0&end=86400&step=1", wantErr: "range of 24h0m0s at step 1s exceeds 11000 points"},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/query_range?"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			_, _, _, err := parseRangeParams(c)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type RelabelAction string
+
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelLabelMap  RelabelAction = "labelmap"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	RelabelLabelKeep RelabelAction = "labelkeep"
+	RelabelHashMod   RelabelAction = "hashmod"
+)
+
+// Reserved target labels set before target relabeling. Labels starting with
+// "__" are removed once relabeling is done.
+const (
+	AddressLabel     = "__address__"
+	SchemeLabel      = "__scheme__"
+	MetricsPathLabel = "__metrics_path__"
+)
+
+// RelabelConfig is a Prometheus-style relabeling rule
+type RelabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels" json:"source_labels"`
+	Separator    string        `yaml:"separator" json:"separator"`
+	Regex        string        `yaml:"regex" json:"regex"`
+	Modulus      uint64        `yaml:"modulus" json:"modulus"`
+	TargetLabel  string        `yaml:"target_label" json:"target_label"`
+	Replacement  *string       `yaml:"replacement" json:"replacement"`
+	Action       RelabelAction `yaml:"action" json:"action"`
+
+	regex *regexp.Regexp
+}
+
+// Compile validates the rule, fills in defaults and compiles its regex. It
+// must be called before the rule is used.
+func (c *RelabelConfig) Compile() error {
+	if c.Action == "" {
+		c.Action = RelabelReplace
+	}
+	if c.Separator == "" {
+		c.Separator = ";"
+	}
+	if c.Regex == "" {
+		c.Regex = "(.*)"
+	}
+	if c.Replacement == nil {
+		replacement := "$1"
+		c.Replacement = &replacement
+	}
+
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex %q: %w", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires target_label", c.Action)
+		}
+	case RelabelHashMod:
+		if c.TargetLabel == "" || c.Modulus == 0 {
+			return fmt.Errorf("relabel action %s requires target_label and modulus", c.Action)
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+
+	return nil
+}
+
+// CompileRelabelConfigs compiles every rule in order
+func CompileRelabelConfigs(cfgs []*RelabelConfig) error {
+	for i, cfg := range cfgs {
+		if err := cfg.Compile(); err != nil {
+			return fmt.Errorf("relabel config %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Relabel applies the rules in order and returns the resulting labels. It
+// returns false when a keep or drop rule discards the label set.
+func Relabel(ls Labels, cfgs []*RelabelConfig) (Labels, bool) {
+	if len(cfgs) == 0 {
+		return ls, true
+	}
+
+	b := NewLabelsBuilder(ls)
+	for _, cfg := range cfgs {
+		if !cfg.apply(b) {
+			return nil, false
+		}
+	}
+
+	return b.Labels(), true
+}
+
+func (c *RelabelConfig) apply(b *LabelsBuilder) bool {
+	values := make([]string, len(c.SourceLabels))
+	for i, name := range c.SourceLabels {
+		values[i] = b.Get(name)
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case RelabelKeep:
+		return c.regex.MatchString(value)
+	case RelabelDrop:
+		return !c.regex.MatchString(value)
+	case RelabelReplace:
+		match := c.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value, match))
+		if target == "" {
+			return true
+		}
+		b.Set(target, string(c.regex.ExpandString(nil, *c.Replacement, value, match)))
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(value))
+		mod := binary.BigEndian.Uint64(sum[8:]) % c.Modulus
+		b.Set(c.TargetLabel, fmt.Sprint(mod))
+	case RelabelLabelMap:
+		for name, v := range NewLabelsBuilder(b.Labels()).labels {
+			if c.regex.MatchString(name) {
+				b.Set(c.regex.ReplaceAllString(name, *c.Replacement), v)
+			}
+		}
+	case RelabelLabelDrop:
+		for name := range b.labels {
+			if c.regex.MatchString(name) {
+				b.Del(name)
+			}
+		}
+	case RelabelLabelKeep:
+		for name := range b.labels {
+			if !c.regex.MatchString(name) {
+				b.Del(name)
+			}
+		}
+	}
+
+	return true
+}
+
+// relabelTarget runs target relabeling over a discovered target. The
+// address, scheme and metrics path are exposed as reserved labels and read
+// back afterwards; every other label starting with "__" is discarded. job is
+// the job label of targets without one.
+func relabelTarget(target ScrapeOptions, job string, cfgs []*RelabelConfig) (ScrapeOptions, bool) {
+	scheme, address := "http", target.Host
+	if i := strings.Index(target.Host, "://"); i >= 0 {
+		scheme, address = target.Host[:i], target.Host[i+3:]
+	}
+	path := target.Path
+	if path == "" {
+		path = DefaultScrapePath
+	}
+
+	b := NewLabelsBuilder(LabelsFromMap(target.Labels))
+	b.Set(AddressLabel, address)
+	b.Set(SchemeLabel, scheme)
+	b.Set(MetricsPathLabel, path)
+	if b.Get(JobLabel) == "" {
+		b.Set(JobLabel, job)
+	}
+
+	ls, keep := Relabel(b.Labels(), cfgs)
+	if !keep || ls.Get(AddressLabel) == "" {
+		return ScrapeOptions{}, false
+	}
+
+	labels := make(map[string]string, len(ls))
+	for _, l := range ls {
+		if !strings.HasPrefix(l.Name, "__") {
+			labels[l.Name] = l.Value
+		}
+	}
+
+	target.Host = ls.Get(SchemeLabel) + "://" + ls.Get(AddressLabel)
+	target.Path = ls.Get(MetricsPathLabel)
+	target.Labels = labels
+
+	return target, true
+}
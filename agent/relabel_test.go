@@ -0,0 +1,303 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestRelabel(t *testing.T) {
+	input := LabelsFromMap(map[string]string{
+		MetricNameLabel: "http_requests_total",
+		"instance":      "web:8080",
+		"job":           "docker",
+		"method":        "GET",
+		"path":          "/api",
+	})
+
+	tests := []struct {
+		name string
+		cfgs []*RelabelConfig
+		want map[string]string
+		drop bool
+	}{
+		{
+			name: "no rules",
+			want: input.Map(),
+		},
+		{
+			name: "keep matching",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"method"}, Regex: "GET|HEAD", Action: RelabelKeep}},
+			want: input.Map(),
+		},
+		{
+			name: "keep not matching",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"method"}, Regex: "POST", Action: RelabelKeep}},
+			drop: true,
+		},
+		{
+			name: "keep is anchored",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"method"}, Regex: "GE", Action: RelabelKeep}},
+			drop: true,
+		},
+		{
+			name: "drop matching",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{MetricNameLabel}, Regex: "http_.*", Action: RelabelDrop}},
+			drop: true,
+		},
+		{
+			name: "drop not matching",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{MetricNameLabel}, Regex: "go_.*", Action: RelabelDrop}},
+			want: input.Map(),
+		},
+		{
+			name: "drop joined source labels",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"method", "path"}, Regex: "GET;/api", Action: RelabelDrop}},
+			drop: true,
+		},
+		{
+			name: "replace with groups",
+			cfgs: []*RelabelConfig{{
+				SourceLabels: []string{"instance"},
+				Regex:        "(.+):(\\d+)",
+				TargetLabel:  "host",
+				Replacement:  stringPtr("$1"),
+			}},
+			want: merge(input.Map(), map[string]string{"host": "web"}),
+		},
+		{
+			name: "replace defaults",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"path"}, TargetLabel: "route"}},
+			want: merge(input.Map(), map[string]string{"route": "/api"}),
+		},
+		{
+			name: "replace not matching",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"method"}, Regex: "POST", TargetLabel: "write", Replacement: stringPtr("true")}},
+			want: input.Map(),
+		},
+		{
+			name: "replace with empty value deletes",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"missing"}, TargetLabel: "path"}},
+			want: without(input.Map(), "path"),
+		},
+		{
+			name: "replace metric name",
+			cfgs: []*RelabelConfig{{
+				SourceLabels: []string{MetricNameLabel},
+				Regex:        "http_(.*)",
+				TargetLabel:  MetricNameLabel,
+				Replacement:  stringPtr("web_$1"),
+			}},
+			want: merge(input.Map(), map[string]string{MetricNameLabel: "web_requests_total"}),
+		},
+		{
+			name: "labelmap",
+			cfgs: []*RelabelConfig{{Regex: "(method|path)", Replacement: stringPtr("http_$1"), Action: RelabelLabelMap}},
+			want: merge(input.Map(), map[string]string{"http_method": "GET", "http_path": "/api"}),
+		},
+		{
+			name: "labeldrop",
+			cfgs: []*RelabelConfig{{Regex: "method|path", Action: RelabelLabelDrop}},
+			want: without(input.Map(), "method", "path"),
+		},
+		{
+			name: "labelkeep",
+			cfgs: []*RelabelConfig{{Regex: "__name__|job", Action: RelabelLabelKeep}},
+			want: map[string]string{MetricNameLabel: "http_requests_total", "job": "docker"},
+		},
+		{
+			name: "hashmod",
+			cfgs: []*RelabelConfig{{SourceLabels: []string{"instance"}, Modulus: 4, TargetLabel: "shard", Action: RelabelHashMod}},
+			want: merge(input.Map(), map[string]string{"shard": "1"}),
+		},
+		{
+			name: "rules apply in order",
+			cfgs: []*RelabelConfig{
+				{SourceLabels: []string{"path"}, TargetLabel: "route"},
+				{Regex: "path", Action: RelabelLabelDrop},
+				{SourceLabels: []string{"route"}, Regex: "/api", Action: RelabelKeep},
+			},
+			want: merge(without(input.Map(), "path"), map[string]string{"route": "/api"}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CompileRelabelConfigs(tt.cfgs); err != nil {
+				t.Fatal(err)
+			}
+
+			got, keep := Relabel(input.Copy(), tt.cfgs)
+			if keep == tt.drop {
+				t.Fatalf("keep = %v, want %v", keep, !tt.drop)
+			}
+			if tt.drop {
+				return
+			}
+			if !reflect.DeepEqual(got.Map(), tt.want) {
+				t.Errorf("got %v, want %v", got.Map(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRelabelHashModIsStable(t *testing.T) {
+	cfgs := []*RelabelConfig{{SourceLabels: []string{"instance"}, Modulus: 8, TargetLabel: "shard", Action: RelabelHashMod}}
+	if err := CompileRelabelConfigs(cfgs); err != nil {
+		t.Fatal(err)
+	}
+
+	shards := make(map[string]bool)
+	for _, instance := range []string{"a:1", "b:1", "c:1", "d:1", "e:1", "f:1", "g:1", "h:1"} {
+		ls := LabelsFromMap(map[string]string{"instance": instance})
+		first, _ := Relabel(ls, cfgs)
+		second, _ := Relabel(ls, cfgs)
+		if first.Get("shard") != second.Get("shard") {
+			t.Fatalf("shard of %s changed between runs", instance)
+		}
+		shards[first.Get("shard")] = true
+	}
+	if len(shards) < 2 {
+		t.Errorf("every instance hashed to the same shard")
+	}
+}
+
+func TestCompileRelabelConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RelabelConfig
+		wantErr bool
+	}{
+		{name: "replace", cfg: RelabelConfig{TargetLabel: "a"}},
+		{name: "replace without target", cfg: RelabelConfig{Action: RelabelReplace}, wantErr: true},
+		{name: "hashmod without modulus", cfg: RelabelConfig{Action: RelabelHashMod, TargetLabel: "a"}, wantErr: true},
+		{name: "invalid regex", cfg: RelabelConfig{Action: RelabelKeep, Regex: "("}, wantErr: true},
+		{name: "unknown action", cfg: RelabelConfig{Action: "rename"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Compile(); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelabelTarget(t *testing.T) {
+	docker := ScrapeOptions{
+		Host: "http://172.18.0.2:9100",
+		Labels: map[string]string{
+			MetaDockerContainerNameLabel:                 "web-1",
+			MetaDockerLabelPrefix + "com_docker_compose": "shop",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		target  ScrapeOptions
+		job     string
+		cfgs    []*RelabelConfig
+		wantURL string
+		want    map[string]string
+		dropped bool
+	}{
+		{
+			name:    "meta labels are discarded",
+			target:  docker,
+			job:     "docker",
+			wantURL: "http://172.18.0.2:9100/metrics",
+			want:    map[string]string{JobLabel: "docker"},
+		},
+		{
+			name:    "own job label is kept",
+			target:  ScrapeOptions{Host: "http://db:9187", Labels: map[string]string{JobLabel: "postgres"}},
+			job:     "file",
+			wantURL: "http://db:9187/metrics",
+			want:    map[string]string{JobLabel: "postgres"},
+		},
+		{
+			name:   "meta labels copied to target labels",
+			target: docker,
+			job:    "docker",
+			cfgs: []*RelabelConfig{
+				{SourceLabels: []string{MetaDockerContainerNameLabel}, TargetLabel: "container"},
+				{SourceLabels: []string{JobLabel, MetaDockerLabelPrefix + "com_docker_compose"}, Separator: "/", TargetLabel: JobLabel},
+			},
+			wantURL: "http://172.18.0.2:9100/metrics",
+			want:    map[string]string{JobLabel: "docker/shop", "container": "web-1"},
+		},
+		{
+			name:   "address, scheme and path rewritten",
+			target: docker,
+			job:    "docker",
+			cfgs: []*RelabelConfig{
+				{SourceLabels: []string{AddressLabel}, Regex: "(.+):\\d+", TargetLabel: AddressLabel, Replacement: stringPtr("$1:9200")},
+				{TargetLabel: SchemeLabel, Replacement: stringPtr("https")},
+				{TargetLabel: MetricsPathLabel, Replacement: stringPtr("/internal/metrics")},
+			},
+			wantURL: "https://172.18.0.2:9200/internal/metrics",
+			want:    map[string]string{JobLabel: "docker"},
+		},
+		{
+			name:    "dropped by job",
+			target:  docker,
+			job:     "docker",
+			cfgs:    []*RelabelConfig{{SourceLabels: []string{JobLabel}, Regex: "docker", Action: RelabelDrop}},
+			dropped: true,
+		},
+		{
+			name:    "dropped without address",
+			target:  docker,
+			job:     "docker",
+			cfgs:    []*RelabelConfig{{Regex: AddressLabel, Action: RelabelLabelDrop}},
+			dropped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CompileRelabelConfigs(tt.cfgs); err != nil {
+				t.Fatal(err)
+			}
+
+			got, keep := relabelTarget(tt.target, tt.job, tt.cfgs)
+			if keep == tt.dropped {
+				t.Fatalf("keep = %v, want %v", keep, !tt.dropped)
+			}
+			if tt.dropped {
+				return
+			}
+			if got.URL() != tt.wantURL {
+				t.Errorf("url %s, want %s", got.URL(), tt.wantURL)
+			}
+			if !reflect.DeepEqual(got.Labels, tt.want) {
+				t.Errorf("labels %v, want %v", got.Labels, tt.want)
+			}
+		})
+	}
+}
+
+func merge(a, b map[string]string) map[string]string {
+	m := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+
+	return m
+}
+
+func without(a map[string]string, names ...string) map[string]string {
+	m := merge(a, nil)
+	for _, name := range names {
+		delete(m, name)
+	}
+
+	return m
+}
@@ -0,0 +1,410 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRuleEvaluationInterval = time.Minute
+
+	// AlertNameLabel holds the name of the alerting rule of an alert
+	AlertNameLabel = "alertname"
+
+	// resolvedRetention is how long resolved alerts stay listed
+	resolvedRetention = 15 * time.Minute
+
+	notifyTimeout = 30 * time.Second
+)
+
+type AlertState string
+
+const (
+	AlertPending  AlertState = "pending"
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// RuleGroupConfig is a set of rules evaluated together on an interval
+type RuleGroupConfig struct {
+	Name     string        `yaml:"name"`
+	Interval Duration      `yaml:"interval"`
+	Rules    []*RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig is an alerting or a recording rule.
+//
+// For an alerting rule every sample of Expr is an alert that becomes firing
+// once it has been returned for the For duration. Label and annotation values
+// are templates with $labels and $value available.
+//
+// A recording rule stores the result of Expr as the series named Record,
+// with Labels added.
+type RuleConfig struct {
+	Alert       string            `yaml:"alert"`
+	Record      string            `yaml:"record"`
+	Expr        string            `yaml:"expr"`
+	For         Duration          `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	expr      Expr
+	templates map[string]*template.Template
+}
+
+// Compile validates the rule and parses its expression and templates. It
+// must be called before the rule is used.
+func (c *RuleConfig) Compile() error {
+	switch {
+	case c.Alert == "" && c.Record == "":
+		return fmt.Errorf("one of alert or record is required")
+	case c.Alert != "" && c.Record != "":
+		return fmt.Errorf("only one of alert or record may be set")
+	case c.Record != "" && !metricNameRE.MatchString(c.Record):
+		return fmt.Errorf("invalid recording rule name %q", c.Record)
+	case c.Record != "" && (c.For != 0 || len(c.Annotations) > 0):
+		return fmt.Errorf("recording rule %q cannot have for or annotations", c.Record)
+	}
+
+	expr, err := ParseExpr(c.Expr)
+	if err != nil {
+		return fmt.Errorf("invalid expr %q: %w", c.Expr, err)
+	}
+	if t := exprType(expr); t != typeVector && t != typeScalar {
+		return fmt.Errorf("expr %q must return an instant vector or scalar, got %s", c.Expr, t)
+	}
+	c.expr = expr
+
+	if c.Record != "" {
+		return nil
+	}
+
+	c.templates = make(map[string]*template.Template)
+	for kind, values := range map[string]map[string]string{"label": c.Labels, "annotation": c.Annotations} {
+		for name, text := range values {
+			tmpl, err := template.New(name).Option("missingkey=zero").
+				Parse("{{$labels := .Labels}}{{$value := .Value}}" + text)
+			if err != nil {
+				return fmt.Errorf("invalid %s template %q: %w", kind, name, err)
+			}
+			c.templates[kind+"/"+name] = tmpl
+		}
+	}
+
+	return nil
+}
+
+// Name returns the alert or recorded series name of the rule
+func (c *RuleConfig) Name() string {
+	if c.Record != "" {
+		return c.Record
+	}
+
+	return c.Alert
+}
+
+// CompileRuleGroups compiles every rule of every group
+func CompileRuleGroups(groups []*RuleGroupConfig) error {
+	names := make(map[string]bool)
+	for i, group := range groups {
+		if group.Name == "" {
+			return fmt.Errorf("group %d: name is required", i)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("duplicate group name %q", group.Name)
+		}
+		names[group.Name] = true
+
+		for j, rule := range group.Rules {
+			if err := rule.Compile(); err != nil {
+				return fmt.Errorf("group %q rule %d: %w", group.Name, j, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *RuleConfig) expand(kind, name string, labels Labels, value float64) string {
+	var b bytes.Buffer
+	err := c.templates[kind+"/"+name].Execute(&b, struct {
+		Labels map[string]string
+		Value  float64
+	}{labels.Map(), value})
+	if err != nil {
+		log.Warn().Err(err).Str("alert", c.Alert).Str(kind, name).Msg("error expanding template")
+		return fmt.Sprintf("<error expanding template: %s>", err)
+	}
+
+	return b.String()
+}
+
+// Alert is one series returned by an alerting rule
+type Alert struct {
+	Fingerprint string            `json:"fingerprint"`
+	Labels      Labels            `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	State       AlertState        `json:"state"`
+	Value       string            `json:"value"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`
+	// SilencedBy lists the silences muting the alert
+	SilencedBy []string `json:"silencedBy,omitempty"`
+}
+
+// Notifier receives every firing alert after each evaluation of its rule, and
+// an alert once more when it is resolved
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert) error
+}
+
+type RuleManagerOptions struct {
+	Groups    []*RuleGroupConfig
+	Queryable Queryable
+	Notifier  Notifier
+	// Appender stores the results of recording rules
+	Appender Appender
+	// Hub receives the results of recording rules
+	Hub *Hub
+}
+
+// RuleManager evaluates the rule groups and tracks the state of their alerts
+type RuleManager struct {
+	Options RuleManagerOptions
+
+	engine *Engine
+
+	mu     sync.Mutex
+	active map[*RuleConfig]map[uint64]*Alert
+}
+
+func NewRuleManager(opts RuleManagerOptions) *RuleManager {
+	return &RuleManager{
+		Options: opts,
+		engine:  NewEngine(opts.Queryable),
+		active:  make(map[*RuleConfig]map[uint64]*Alert),
+	}
+}
+
+// Run evaluates every group on its interval until ctx is cancelled
+func (m *RuleManager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, group := range m.Options.Groups {
+		wg.Add(1)
+		go func(group *RuleGroupConfig) {
+			defer wg.Done()
+			m.runGroup(ctx, group)
+		}(group)
+	}
+
+	wg.Wait()
+}
+
+func (m *RuleManager) runGroup(ctx context.Context, group *RuleGroupConfig) {
+	interval := time.Duration(group.Interval)
+	if interval <= 0 {
+		interval = DefaultRuleEvaluationInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.evalGroup(ctx, group, time.Now())
+	}
+}
+
+func (m *RuleManager) evalGroup(ctx context.Context, group *RuleGroupConfig, ts time.Time) {
+	var notify []Alert
+	for _, rule := range group.Rules {
+		if rule.Record != "" {
+			if err := m.evalRecordingRule(rule, ts); err != nil {
+				log.Error().Err(err).Str("group", group.Name).Str("rule", rule.Name()).Msg("error evaluating rule")
+			}
+			continue
+		}
+
+		alerts, err := m.evalRule(rule, ts)
+		if err != nil {
+			log.Error().Err(err).Str("group", group.Name).Str("rule", rule.Name()).Msg("error evaluating rule")
+			continue
+		}
+		notify = append(notify, alerts...)
+	}
+
+	if len(notify) == 0 || m.Options.Notifier == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	if err := m.Options.Notifier.Notify(ctx, notify); err != nil {
+		log.Error().Err(err).Str("group", group.Name).Msg("error sending alert notifications")
+	}
+}
+
+// evalRecordingRule stores the result of the rule. Later rules of the group
+// see it because they are evaluated at the same time.
+func (m *RuleManager) evalRecordingRule(rule *RuleConfig, ts time.Time) error {
+	if m.Options.Appender == nil {
+		return fmt.Errorf("recording rules require storage")
+	}
+
+	value, err := m.engine.InstantExpr(rule.expr, ts)
+	if err != nil {
+		return err
+	}
+
+	var vector Vector
+	switch v := value.(type) {
+	case Vector:
+		vector = v
+	case Scalar:
+		vector = Vector{{Point: Point(v)}}
+	}
+
+	samples := make([]Sample, 0, len(vector))
+	recorded := make(map[string]bool, len(vector))
+	for _, sample := range vector {
+		lb := NewLabelsBuilder(sample.Metric)
+		for name, value := range rule.Labels {
+			lb.Set(name, value)
+		}
+		lb.Set(MetricNameLabel, rule.Record)
+		labels := lb.Labels()
+
+		key := labels.String()
+		if recorded[key] {
+			return fmt.Errorf("result contains %s more than once after applying rule labels", key)
+		}
+		recorded[key] = true
+		samples = append(samples, Sample{Labels: labels, T: ts.UnixMilli(), V: sample.Point.V})
+	}
+
+	if len(samples) == 0 {
+		return nil
+	}
+	if err := m.Options.Appender.Append(samples); err != nil {
+		return fmt.Errorf("failed storing recorded samples: %w", err)
+	}
+
+	publishSamples(m.Options.Hub, MetricsMessageRecord, rule.Record, samples)
+
+	return nil
+}
+
+// evalRule updates the alerts of the rule and returns those that are firing
+// or were resolved by this evaluation
+func (m *RuleManager) evalRule(rule *RuleConfig, ts time.Time) ([]Alert, error) {
+	value, err := m.engine.InstantExpr(rule.expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	var vector Vector
+	switch v := value.(type) {
+	case Vector:
+		vector = v
+	case Scalar:
+		vector = Vector{{Point: Point(v)}}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := m.active[rule]
+	if active == nil {
+		active = make(map[uint64]*Alert)
+		m.active[rule] = active
+	}
+
+	seen := make(map[uint64]bool, len(vector))
+	for _, sample := range vector {
+		lb := NewLabelsBuilder(sample.Metric).Del(MetricNameLabel)
+		base := lb.Labels()
+		for name := range rule.Labels {
+			lb.Set(name, rule.expand("label", name, base, sample.Point.V))
+		}
+		lb.Set(AlertNameLabel, rule.Alert)
+		labels := lb.Labels()
+
+		annotations := make(map[string]string, len(rule.Annotations))
+		for name := range rule.Annotations {
+			annotations[name] = rule.expand("annotation", name, base, sample.Point.V)
+		}
+
+		h := labels.Hash()
+		seen[h] = true
+		if alert, ok := active[h]; ok && alert.State != AlertResolved {
+			alert.Value, alert.Annotations = formatFloat(sample.Point.V), annotations
+			continue
+		}
+
+		active[h] = &Alert{
+			Fingerprint: strconv.FormatUint(h, 16),
+			Labels:      labels,
+			Annotations: annotations,
+			State:       AlertPending,
+			Value:       formatFloat(sample.Point.V),
+			ActiveAt:    ts,
+		}
+	}
+
+	var notify []Alert
+	for h, alert := range active {
+		switch {
+		case alert.State == AlertResolved:
+			if ts.Sub(*alert.ResolvedAt) > resolvedRetention {
+				delete(active, h)
+			}
+			continue
+		case !seen[h]:
+			if alert.State == AlertPending {
+				delete(active, h)
+				continue
+			}
+			resolvedAt := ts
+			alert.State, alert.ResolvedAt = AlertResolved, &resolvedAt
+		case alert.State == AlertPending && ts.Sub(alert.ActiveAt) >= time.Duration(rule.For):
+			firedAt := ts
+			alert.State, alert.FiredAt = AlertFiring, &firedAt
+		}
+
+		if alert.State != AlertPending {
+			notify = append(notify, *alert)
+		}
+	}
+
+	return notify, nil
+}
+
+// Alerts returns every pending, firing and recently resolved alert
+func (m *RuleManager) Alerts() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []Alert
+	for _, active := range m.active {
+		for _, alert := range active {
+			alerts = append(alerts, *alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return compareLabels(alerts[i].Labels, alerts[j].Labels) < 0 })
+
+	return alerts
+}
@@ -2,59 +2,399 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultScrapePath            = "/metrics"
+	DefaultScrapeIntervalSeconds = 10
+	DefaultScrapeTimeoutSeconds  = 10
+	DefaultScrapeMaxBodyBytes    = 10 << 20
+)
+
+var errBodyTooLarge = errors.New("response body exceeds size limit")
+
+// Target health values reported in TargetStatus
+const (
+	HealthUnknown = "unknown"
+	HealthUp      = "up"
+	HealthDown    = "down"
 )
 
 type ScrapeOptions struct {
 	Host            string
+	Path            string
 	IntervalSeconds int
-	Channel         chan<- []byte
+	// TimeoutSeconds bounds a whole scrape including retries and is capped
+	// at the interval so that a scrape never overlaps the next one
+	TimeoutSeconds int
+	// MaxBodyBytes fails scrapes whose response is larger than the limit
+	MaxBodyBytes int64
+	// Labels are attached to every sample scraped from the target
+	Labels map[string]string
+	// MetricRelabelConfigs are applied to every scraped sample
+	MetricRelabelConfigs []*RelabelConfig
+	Hub                  *Hub
+	// Appender stores every sample of a scrape, when set
+	Appender Appender
+}
+
+// Types of the messages published to the Hub
+const (
+	MetricsMessageScrape = "scrape"
+	MetricsMessageRecord = "record"
+)
+
+// MetricsMessage is published to the Hub with the samples of a scrape, after
+// metric relabeling, or of a recording rule evaluation
+type MetricsMessage struct {
+	Type string `json:"type"`
+	// Source is the URL of the scraped target or the name of the recording
+	// rule
+	Source  string         `json:"source"`
+	Samples []MetricSample `json:"samples"`
+}
+
+type MetricSample struct {
+	Metric    Labels  `json:"metric"`
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// publishSamples sends the samples to the subscribers of hub, if any
+func publishSamples(hub *Hub, kind, source string, samples []Sample) {
+	if hub == nil || hub.Len() == 0 {
+		return
+	}
+
+	msg := MetricsMessage{Type: kind, Source: source, Samples: make([]MetricSample, len(samples))}
+	for i, sample := range samples {
+		msg.Samples[i] = MetricSample{Metric: sample.Labels, Timestamp: sample.T, Value: sample.V}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Error().Err(err).Str("source", source).Msg("failed encoding metrics message")
+		return
+	}
+	hub.Publish(data)
+}
+
+// URL identifies the scraped endpoint
+func (o ScrapeOptions) URL() string {
+	path := o.Path
+	if path == "" {
+		path = DefaultScrapePath
+	}
+
+	return o.Host + path
+}
+
+// TargetStatus describes the outcome of the most recent scrapes of a target
+type TargetStatus struct {
+	URL                       string            `json:"url"`
+	Instance                  string            `json:"instance"`
+	Job                       string            `json:"job"`
+	Labels                    map[string]string `json:"labels"`
+	IntervalSeconds           int               `json:"intervalSeconds"`
+	Health                    string            `json:"health"`
+	LastError                 string            `json:"lastError,omitempty"`
+	LastScrape                time.Time         `json:"lastScrape"`
+	LastSuccess               time.Time         `json:"lastSuccess"`
+	TimeoutSeconds            int               `json:"timeoutSeconds"`
+	LastScrapeDurationSeconds float64           `json:"lastScrapeDurationSeconds"`
+	SamplesScraped            int               `json:"samplesScraped"`
+	SamplesPostRelabeling     int               `json:"samplesPostMetricRelabeling"`
 }
 
 type Scraper struct {
 	Options ScrapeOptions
 
 	client *SturdyClient
+	// labels are the target labels including the instance and job labels
+	labels map[string]string
+
+	mu      sync.RWMutex
+	status  TargetStatus
+	samples []Sample
 }
 
 func NewScraper(opts ScrapeOptions) *Scraper {
-	client := NewSturdyHTTPClient()
+	if opts.Path == "" {
+		opts.Path = DefaultScrapePath
+	}
+	if opts.IntervalSeconds <= 0 {
+		opts.IntervalSeconds = DefaultScrapeIntervalSeconds
+	}
+	if opts.TimeoutSeconds <= 0 {
+		opts.TimeoutSeconds = DefaultScrapeTimeoutSeconds
+	}
+	if opts.TimeoutSeconds > opts.IntervalSeconds {
+		opts.TimeoutSeconds = opts.IntervalSeconds
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = DefaultScrapeMaxBodyBytes
+	}
+
+	// retries share the scrape timeout, so back off on a scale of the
+	// timeout rather than the default API backoff of several seconds
+	timeout := time.Duration(opts.TimeoutSeconds) * time.Second
+	client := NewSturdyHTTPClient().
+		SetRetryWaitTime(timeout / 10).
+		SetRetryMaxWaitTime(timeout / 2)
 	client.SetBaseURL(opts.Host)
+	client.SetTransport(&limitedTransport{
+		base:  client.GetClient().Transport,
+		limit: opts.MaxBodyBytes,
+	})
 
-	return &Scraper{opts, client}
+	instance := opts.Host
+	if u, err := url.Parse(opts.Host); err == nil && u.Host != "" {
+		instance = u.Host
+	}
+
+	labels := map[string]string{InstanceLabel: instance}
+	for name, value := range opts.Labels {
+		labels[name] = value
+	}
+
+	return &Scraper{
+		Options: opts,
+		client:  client,
+		labels:  labels,
+		status: TargetStatus{
+			URL:             opts.URL(),
+			Instance:        labels[InstanceLabel],
+			Job:             labels[JobLabel],
+			Labels:          opts.Labels,
+			IntervalSeconds: opts.IntervalSeconds,
+			TimeoutSeconds:  opts.TimeoutSeconds,
+			Health:          HealthUnknown,
+		},
+	}
 }
 
+// Status returns the health of the target as of the last scrape
+func (s *Scraper) Status() TargetStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.status
+}
+
+// Samples returns the samples of the last scrape including the synthetic
+// up, scrape_duration_seconds and scrape_samples_scraped series
+func (s *Scraper) Samples() []Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.samples
+}
+
+// Offset returns the delay before the first scrape. It is derived from the
+// target URL so that targets sharing an interval are spread across it
+// instead of scraping in lockstep, and stays stable across restarts.
+func (s *Scraper) Offset() time.Duration {
+	interval := time.Duration(s.Options.IntervalSeconds) * time.Second
+
+	return time.Duration(xxhash.Sum64String(s.Options.URL()) % uint64(interval))
+}
+
+// Scrape scrapes the target every interval until ctx is cancelled. Scrapes
+// run one at a time: a tick that fires while a scrape is still running is
+// dropped rather than queued, and the scrape timeout (including retries)
+// never exceeds the interval.
 func (s *Scraper) Scrape(ctx context.Context) error {
+	offset := time.NewTimer(s.Offset())
+	select {
+	case <-ctx.Done():
+		offset.Stop()
+		return nil
+	case <-offset.C:
+	}
+
 	ticker := time.NewTicker(time.Duration(s.Options.IntervalSeconds) * time.Second)
+	s.scrape(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			ticker.Stop()
 			return nil
 		case <-ticker.C:
-			err := s.scrapeTarget(ctx)
-			if err != nil {
-				fmt.Println(err)
-			}
+			s.scrape(ctx)
 		}
 	}
 }
 
-func (s *Scraper) scrapeTarget(ctx context.Context) error {
+func (s *Scraper) scrape(ctx context.Context) {
+	start := time.Now()
+	ts := start.UnixMilli()
+
+	scrapeCtx, cancel := context.WithTimeout(ctx, time.Duration(s.Options.TimeoutSeconds)*time.Second)
+	samples, err := s.scrapeTarget(scrapeCtx, ts)
+	cancel()
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		// the target was removed mid-scrape, this is not a target failure
+		return
+	}
+
+	up := 1.0
+	if err != nil {
+		up = 0
+		samples = nil
+		log.Warn().Err(err).Str("target", s.Options.URL()).Msg("scrape failed")
+	}
+
+	scraped := len(samples)
+	samples = s.relabelSamples(samples)
+	kept := len(samples)
+	if err == nil {
+		publishSamples(s.Options.Hub, MetricsMessageScrape, s.Options.URL(), samples)
+	}
+
+	samples = append(samples,
+		s.syntheticSample("up", ts, up),
+		s.syntheticSample("scrape_duration_seconds", ts, duration.Seconds()),
+		s.syntheticSample("scrape_samples_scraped", ts, float64(scraped)),
+		s.syntheticSample("scrape_samples_post_metric_relabeling", ts, float64(kept)),
+	)
+
+	if s.Options.Appender != nil {
+		if err := s.Options.Appender.Append(samples); err != nil {
+			log.Error().Err(err).Str("target", s.Options.URL()).Msg("failed storing samples")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = samples
+	s.status.LastScrape = start
+	s.status.LastScrapeDurationSeconds = duration.Seconds()
+	s.status.SamplesScraped = scraped
+	s.status.SamplesPostRelabeling = kept
+	if err != nil {
+		s.status.Health = HealthDown
+		s.status.LastError = err.Error()
+	} else {
+		s.status.Health = HealthUp
+		s.status.LastError = ""
+		s.status.LastSuccess = start
+	}
+}
+
+func (s *Scraper) scrapeTarget(ctx context.Context, ts int64) ([]Sample, error) {
 	// scrape the target
 	response, err := s.client.R().
 		SetContext(ctx).
-		Get("/metrics")
+		Get(s.Options.Path)
 	if err != nil {
-		return fmt.Errorf("failed performing request to get metrics: %w", err)
+		return nil, fmt.Errorf("failed performing request to get metrics: %w", err)
 	}
 
+	body := response.Body()
 	if response.IsError() {
-		return fmt.Errorf("error getting metrics: %s", response.Body())
+		return nil, fmt.Errorf("error getting metrics: %s", body)
+	}
+
+	samples, err := ParseSamples(body, ts)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing metrics: %w", err)
+	}
+
+	for i := range samples {
+		samples[i].Labels = s.targetLabels(samples[i].Labels)
+	}
+
+	return samples, nil
+}
+
+// relabelSamples applies metric relabeling, dropping discarded samples
+func (s *Scraper) relabelSamples(samples []Sample) []Sample {
+	if len(s.Options.MetricRelabelConfigs) == 0 {
+		return samples
+	}
+
+	kept := samples[:0]
+	for _, sample := range samples {
+		labels, keep := Relabel(sample.Labels, s.Options.MetricRelabelConfigs)
+		if !keep || labels.Get(MetricNameLabel) == "" {
+			continue
+		}
+		sample.Labels = labels
+		kept = append(kept, sample)
+	}
+
+	return kept
+}
+
+// targetLabels attaches the target labels to a scraped label set. Scraped
+// labels that clash with a target label are kept as exported_<name>.
+func (s *Scraper) targetLabels(scraped Labels) Labels {
+	b := NewLabelsBuilder(scraped)
+	for name, value := range s.labels {
+		if existing := b.Get(name); existing != "" {
+			b.Set("exported_"+name, existing)
+		}
+		b.Set(name, value)
 	}
 
-	s.Options.Channel <- response.Body()
+	return b.Labels()
+}
+
+func (s *Scraper) syntheticSample(name string, ts int64, value float64) Sample {
+	return Sample{
+		Labels: s.targetLabels(Labels{{Name: MetricNameLabel, Value: name}}),
+		T:      ts,
+		V:      value,
+	}
+}
+
+// limitedTransport fails reading any response body larger than limit
+type limitedTransport struct {
+	base  http.RoundTripper
+	limit int64
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, remaining: t.limit}
+
+	return res, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
 
-	return nil
+	return n, err
 }
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// expiredSilenceRetention is how long expired silences stay listed
+const expiredSilenceRetention = 24 * time.Hour
+
+var ErrSilenceNotFound = errors.New("silence not found")
+
+type SilenceState string
+
+const (
+	SilencePending SilenceState = "pending"
+	SilenceActive  SilenceState = "active"
+	SilenceExpired SilenceState = "expired"
+)
+
+type SilenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	// IsEqual defaults to true, false negates the matcher
+	IsEqual *bool `json:"isEqual,omitempty"`
+}
+
+// Silence mutes notifications for alerts matching all of its matchers
+// between StartsAt and EndsAt
+type Silence struct {
+	ID        string           `json:"id"`
+	Matchers  []SilenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+
+	matchers []*Matcher
+}
+
+func (s *Silence) State(now time.Time) SilenceState {
+	switch {
+	case now.Before(s.StartsAt):
+		return SilencePending
+	case now.Before(s.EndsAt):
+		return SilenceActive
+	}
+
+	return SilenceExpired
+}
+
+// MarshalJSON adds the state of the silence at the time of marshaling
+func (s Silence) MarshalJSON() ([]byte, error) {
+	type silence Silence
+	return json.Marshal(struct {
+		silence
+		Status SilenceState `json:"status"`
+	}{silence(s), s.State(time.Now())})
+}
+
+func (s *Silence) compile() error {
+	if len(s.Matchers) == 0 {
+		return fmt.Errorf("at least one matcher is required")
+	}
+
+	s.matchers = make([]*Matcher, 0, len(s.Matchers))
+	for _, sm := range s.Matchers {
+		if sm.Name == "" {
+			return fmt.Errorf("matcher name is required")
+		}
+
+		typ := MatchEqual
+		switch equal := sm.IsEqual == nil || *sm.IsEqual; {
+		case sm.IsRegex && equal:
+			typ = MatchRegexp
+		case sm.IsRegex:
+			typ = MatchNotRegexp
+		case !equal:
+			typ = MatchNotEqual
+		}
+
+		m, err := NewMatcher(typ, sm.Name, sm.Value)
+		if err != nil {
+			return err
+		}
+		s.matchers = append(s.matchers, m)
+	}
+
+	return nil
+}
+
+// Silences stores silences in a JSON file so that they survive restarts
+type Silences struct {
+	path string
+
+	mu       sync.Mutex
+	silences map[string]*Silence
+}
+
+// OpenSilences loads the silences stored at path. An empty path keeps them
+// in memory only.
+func OpenSilences(path string) (*Silences, error) {
+	s := &Silences{path: path, silences: make(map[string]*Silence)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading silences: %w", err)
+	}
+
+	var silences []*Silence
+	if err := json.Unmarshal(data, &silences); err != nil {
+		return nil, fmt.Errorf("failed parsing silences: %w", err)
+	}
+	for _, silence := range silences {
+		if err := silence.compile(); err != nil {
+			return nil, fmt.Errorf("silence %s: %w", silence.ID, err)
+		}
+		s.silences[silence.ID] = silence
+	}
+
+	return s, nil
+}
+
+// Set creates a silence, or replaces the one with the same ID, and returns
+// its ID
+func (s *Silences) Set(silence Silence) (string, error) {
+	now := time.Now()
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = now
+	}
+	if !silence.EndsAt.After(silence.StartsAt) {
+		return "", fmt.Errorf("endsAt must be after startsAt")
+	}
+	if !silence.EndsAt.After(now) {
+		return "", fmt.Errorf("endsAt must be in the future")
+	}
+	if err := silence.compile(); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if silence.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return "", fmt.Errorf("failed generating silence id: %w", err)
+		}
+		silence.ID = hex.EncodeToString(id)
+	} else if _, ok := s.silences[silence.ID]; !ok {
+		return "", ErrSilenceNotFound
+	}
+	silence.UpdatedAt = now
+
+	s.silences[silence.ID] = &silence
+	s.gc(now)
+
+	return silence.ID, s.persist()
+}
+
+// Expire ends a silence now
+func (s *Silences) Expire(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	silence, ok := s.silences[id]
+	if !ok {
+		return ErrSilenceNotFound
+	}
+
+	now := time.Now()
+	if silence.State(now) == SilenceExpired {
+		return nil
+	}
+	if silence.StartsAt.After(now) {
+		silence.StartsAt = now
+	}
+	silence.EndsAt, silence.UpdatedAt = now, now
+
+	return s.persist()
+}
+
+func (s *Silences) List() []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	silences := make([]Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		silences = append(silences, *silence)
+	}
+	sort.Slice(silences, func(i, j int) bool { return silences[i].EndsAt.After(silences[j].EndsAt) })
+
+	return silences
+}
+
+// Mutes returns the IDs of the active silences matching the labels
+func (s *Silences) Mutes(labels Labels) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var ids []string
+	for id, silence := range s.silences {
+		if silence.State(now) == SilenceActive && MatchLabels(labels, silence.matchers...) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// gc must be called with s.mu held
+func (s *Silences) gc(now time.Time) {
+	for id, silence := range s.silences {
+		if now.Sub(silence.EndsAt) > expiredSilenceRetention {
+			delete(s.silences, id)
+		}
+	}
+}
+
+// persist must be called with s.mu held
+func (s *Silences) persist() error {
+	if s.path == "" {
+		return nil
+	}
+
+	silences := make([]*Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		silences = append(silences, silence)
+	}
+	data, err := json.MarshalIndent(silences, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed creating silences dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed writing silences: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
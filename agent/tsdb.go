@@ -0,0 +1,717 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRetention          = 15 * 24 * time.Hour
+	DefaultCheckpointInterval = 5 * time.Minute
+
+	// samples per chunk before it is cut and persisted
+	maxChunkSamples = 120
+	// how often expired chunks and series are deleted
+	retentionCheckInterval = 5 * time.Minute
+)
+
+// Badger key prefixes
+const (
+	seriesKeyPrefix byte = 's'
+	chunkKeyPrefix  byte = 'c'
+)
+
+// Appender stores scraped samples
+type Appender interface {
+	Append(samples []Sample) error
+}
+
+type TSDBOptions struct {
+	Path               string
+	Retention          time.Duration
+	CheckpointInterval time.Duration
+}
+
+// Point is one sample of a series
+type Point struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// Series is a label set with its samples in time order
+type Series struct {
+	Labels Labels  `json:"labels"`
+	Points []Point `json:"points"`
+}
+
+// TSDB stores samples per series in Gorilla-compressed chunks. The chunk
+// being filled for each series lives in memory and is protected by a WAL;
+// full chunks and the series index are persisted in BadgerDB under the keys
+//
+//	s<ref>              series labels
+//	c<ref><minT><maxT>  chunk bytes
+//
+// with all integers big endian, so that a series' chunks sort by time.
+type TSDB struct {
+	Options TSDBOptions
+
+	db  *badger.DB
+	wal *wal
+
+	// appendMu serializes appends and WAL writes
+	appendMu sync.Mutex
+	// checkpointMu serializes checkpoints
+	checkpointMu sync.Mutex
+
+	mu      sync.RWMutex
+	series  map[uint64]*memSeries
+	hashes  map[uint64][]*memSeries
+	nextRef uint64
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+type memSeries struct {
+	ref    uint64
+	labels Labels
+
+	// mu guards the head chunk and the hand-off of a full head to badger
+	mu   sync.Mutex
+	head *xorChunk
+	// flushing are former heads a checkpoint is writing to badger, oldest
+	// first. They stay readable until the write is committed.
+	flushing []*xorChunk
+	lastT    int64
+}
+
+// OpenTSDB opens or creates the database at opts.Path and replays its WAL
+func OpenTSDB(opts TSDBOptions) (*TSDB, error) {
+	if opts.Retention <= 0 {
+		opts.Retention = DefaultRetention
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = DefaultCheckpointInterval
+	}
+
+	dbOpts := badger.DefaultOptions(filepath.Join(opts.Path, "chunks")).
+		WithLoggingLevel(badger.WARNING)
+	db, err := badger.Open(dbOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BadgerDB: %w", err)
+	}
+
+	t := &TSDB{
+		Options: opts,
+		db:      db,
+		series:  make(map[uint64]*memSeries),
+		hashes:  make(map[uint64][]*memSeries),
+		nextRef: 1,
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := t.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if t.wal, err = openWAL(filepath.Join(opts.Path, "wal")); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := t.replay(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// persist whatever the replay put in the head so old segments can go
+	if err := t.Checkpoint(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	go t.run()
+
+	return t, nil
+}
+
+// load reads the series index and the newest persisted timestamp per series
+func (t *TSDB) load() error {
+	return t.db.View(func(txn *badger.Txn) error {
+		itr := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer itr.Close()
+
+		prefix := []byte{seriesKeyPrefix}
+		for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+			err := itr.Item().Value(func(val []byte) error {
+				s, err := decodeWALSeries(val)
+				if err != nil {
+					return fmt.Errorf("failed decoding series: %w", err)
+				}
+				t.addSeries(s.ref, s.labels)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		keyOpts := badger.DefaultIteratorOptions
+		keyOpts.PrefetchValues = false
+		keys := txn.NewIterator(keyOpts)
+		defer keys.Close()
+
+		prefix = []byte{chunkKeyPrefix}
+		for keys.Seek(prefix); keys.ValidForPrefix(prefix); keys.Next() {
+			ref, _, maxT := parseChunkKey(keys.Item().Key())
+			if s, ok := t.series[ref]; ok && maxT > s.lastT {
+				s.lastT = maxT
+			}
+		}
+
+		return nil
+	})
+}
+
+func (t *TSDB) replay() error {
+	return t.wal.replay(
+		func(s walSeries) {
+			if _, ok := t.series[s.ref]; ok {
+				return
+			}
+			series := t.addSeries(s.ref, s.labels)
+			if err := t.persistSeries(series); err != nil {
+				log.Error().Err(err).Msg("failed persisting replayed series")
+			}
+		},
+		func(samples []walSample) {
+			for _, sample := range samples {
+				if s, ok := t.series[sample.ref]; ok {
+					t.appendToSeries(s, sample.t, sample.v)
+				}
+			}
+		},
+	)
+}
+
+// addSeries registers a series in memory, t.mu must be held when the
+// database is shared
+func (t *TSDB) addSeries(ref uint64, labels Labels) *memSeries {
+	s := &memSeries{ref: ref, labels: labels, lastT: minTime}
+	t.series[ref] = s
+	hash := labels.Hash()
+	t.hashes[hash] = append(t.hashes[hash], s)
+	if ref >= t.nextRef {
+		t.nextRef = ref + 1
+	}
+
+	return s
+}
+
+func (t *TSDB) getSeries(labels Labels) *memSeries {
+	for _, s := range t.hashes[labels.Hash()] {
+		if s.labels.Equal(labels) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (t *TSDB) persistSeries(s *memSeries) error {
+	return t.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(seriesKey(s.ref), encodeWALSeries(walSeries{ref: s.ref, labels: s.labels}))
+	})
+}
+
+// Append stores samples. Samples that are not newer than the last sample of
+// their series are dropped.
+func (t *TSDB) Append(samples []Sample) error {
+	t.appendMu.Lock()
+	defer t.appendMu.Unlock()
+
+	var (
+		created  []walSeries
+		accepted []walSample
+		targets  []*memSeries
+	)
+
+	t.mu.Lock()
+	for _, sample := range samples {
+		s := t.getSeries(sample.Labels)
+		if s == nil {
+			s = t.addSeries(t.nextRef, sample.Labels.Copy())
+			created = append(created, walSeries{ref: s.ref, labels: s.labels})
+		}
+		targets = append(targets, s)
+	}
+	t.mu.Unlock()
+
+	for i, s := range targets {
+		s.mu.Lock()
+		if samples[i].T > s.lastT {
+			accepted = append(accepted, walSample{ref: s.ref, t: samples[i].T, v: samples[i].V})
+		}
+		s.mu.Unlock()
+	}
+
+	for _, c := range created {
+		if err := t.persistSeries(t.series[c.ref]); err != nil {
+			return err
+		}
+	}
+	if err := t.wal.logSeries(created); err != nil {
+		return err
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	if err := t.wal.logSamples(accepted); err != nil {
+		return err
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, sample := range accepted {
+		t.appendToSeries(t.series[sample.ref], sample.t, sample.v)
+	}
+
+	return nil
+}
+
+func (t *TSDB) appendToSeries(s *memSeries, ts int64, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ts <= s.lastT {
+		return
+	}
+
+	if s.head == nil {
+		s.head = newXORChunk()
+	}
+	s.head.Append(ts, v)
+	s.lastT = ts
+
+	if s.head.NumSamples() >= maxChunkSamples {
+		if err := t.persistHead(s); err != nil {
+			// keep filling the head, the WAL still has the samples
+			log.Error().Err(err).Uint64("series", s.ref).Msg("failed persisting chunk")
+		}
+	}
+}
+
+// persistHead writes the head chunk of s to badger, s.mu must be held
+func (t *TSDB) persistHead(s *memSeries) error {
+	if s.head == nil || s.head.NumSamples() == 0 {
+		return nil
+	}
+
+	err := t.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(chunkKey(s.ref, s.head.minT, s.lastT), s.head.Bytes())
+	})
+	if err != nil {
+		return err
+	}
+	s.head = nil
+
+	return nil
+}
+
+// Checkpoint persists every head chunk and drops the WAL segments that
+// covered them. Appends only wait for the WAL to be cut: every sample of the
+// old segments is in a head by then, and the heads are handed off and
+// written in one batch while new samples go to fresh heads.
+func (t *TSDB) Checkpoint() error {
+	t.checkpointMu.Lock()
+	defer t.checkpointMu.Unlock()
+
+	t.appendMu.Lock()
+	keep, err := t.wal.cut()
+	if err != nil {
+		t.appendMu.Unlock()
+		return fmt.Errorf("failed cutting wal: %w", err)
+	}
+	t.mu.RLock()
+	series := make([]*memSeries, 0, len(t.series))
+	for _, s := range t.series {
+		series = append(series, s)
+	}
+	t.mu.RUnlock()
+	t.appendMu.Unlock()
+
+	batch := t.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	var flushed []*memSeries
+	for _, s := range series {
+		s.mu.Lock()
+		if s.head != nil && s.head.NumSamples() > 0 {
+			s.flushing = append(s.flushing, s.head)
+			s.head = nil
+		}
+		// chunks of a failed checkpoint are written again
+		for _, c := range s.flushing {
+			if err = batch.Set(chunkKey(s.ref, c.minT, c.t), c.Bytes()); err != nil {
+				break
+			}
+		}
+		if len(s.flushing) > 0 {
+			flushed = append(flushed, s)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed persisting chunk: %w", err)
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return fmt.Errorf("failed persisting chunks: %w", err)
+	}
+
+	// only checkpoints add to flushing, so these are the chunks written
+	for _, s := range flushed {
+		s.mu.Lock()
+		s.flushing = nil
+		s.mu.Unlock()
+	}
+
+	return t.wal.truncate(keep)
+}
+
+// Select returns the samples in [mint, maxt] of every series matching all
+// matchers, sorted by labels
+func (t *TSDB) Select(mint, maxt int64, matchers ...*Matcher) ([]Series, error) {
+	t.mu.RLock()
+	var matched []*memSeries
+	for _, s := range t.series {
+		if MatchLabels(s.labels, matchers...) {
+			matched = append(matched, s)
+		}
+	}
+	t.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return compareLabels(matched[i].labels, matched[j].labels) < 0
+	})
+
+	// the in-memory chunks are read before the badger snapshot is taken: a
+	// chunk persisted in between is then found in both and read from memory,
+	// where reading it after the snapshot would find it in neither
+	heads := make([]headSnapshot, len(matched))
+	for i, s := range matched {
+		heads[i] = s.snapshot(mint, maxt)
+	}
+
+	result := make([]Series, 0, len(matched))
+	err := t.db.View(func(txn *badger.Txn) error {
+		for i, s := range matched {
+			points, err := t.readChunks(txn, s, heads[i], mint, maxt)
+			if err != nil {
+				return err
+			}
+			if len(points) > 0 {
+				result = append(result, Series{Labels: s.labels, Points: points})
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// headSnapshot is the in-memory data of a series at one point in time
+type headSnapshot struct {
+	// minTs are the first timestamps of the in-memory chunks
+	minTs  []int64
+	points []Point
+}
+
+func (s *memSeries) snapshot(mint, maxt int64) headSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var snap headSnapshot
+	chunks := s.flushing
+	if s.head != nil && s.head.NumSamples() > 0 {
+		chunks = append(chunks[:len(chunks):len(chunks)], s.head)
+	}
+	for _, c := range chunks {
+		snap.minTs = append(snap.minTs, c.minT)
+		if c.t < mint || c.minT > maxt {
+			continue
+		}
+		// the head chunk is only ever written while s.mu is held
+		if err := collectPoints(&snap.points, c.Iterator(), mint, maxt); err != nil {
+			log.Error().Err(err).Uint64("series", s.ref).Msg("failed reading head chunk")
+		}
+	}
+
+	return snap
+}
+
+// readChunks returns the persisted points of s followed by those of head,
+// skipping the chunks head holds
+func (t *TSDB) readChunks(txn *badger.Txn, s *memSeries, head headSnapshot, mint, maxt int64) ([]Point, error) {
+	var points []Point
+
+	itr := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer itr.Close()
+
+	prefix := seriesChunkPrefix(s.ref)
+	for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+		_, minT, maxT := parseChunkKey(itr.Item().Key())
+		if maxT < mint || minT > maxt || slices.Contains(head.minTs, minT) {
+			continue
+		}
+
+		err := itr.Item().Value(func(val []byte) error {
+			chunk, err := loadXORChunk(val)
+			if err != nil {
+				return err
+			}
+			return collectPoints(&points, chunk.Iterator(), mint, maxt)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed reading chunk of %s: %w", s.labels, err)
+		}
+	}
+
+	return append(points, head.points...), nil
+}
+
+func collectPoints(points *[]Point, it *xorIterator, mint, maxt int64) error {
+	for it.Next() {
+		ts, v := it.At()
+		if ts >= mint && ts <= maxt {
+			*points = append(*points, Point{T: ts, V: v})
+		}
+	}
+
+	return it.Err()
+}
+
+// LabelNames returns every label name in use, sorted
+func (t *TSDB) LabelNames() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	names := make(map[string]struct{})
+	for _, s := range t.series {
+		for _, l := range s.labels {
+			names[l.Name] = struct{}{}
+		}
+	}
+
+	return sortedKeys(names)
+}
+
+// LabelValues returns the values of a label across series matching all
+// matchers, sorted
+func (t *TSDB) LabelValues(name string, matchers ...*Matcher) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	values := make(map[string]struct{})
+	for _, s := range t.series {
+		if value := s.labels.Get(name); value != "" && MatchLabels(s.labels, matchers...) {
+			values[value] = struct{}{}
+		}
+	}
+
+	return sortedKeys(values)
+}
+
+func (t *TSDB) run() {
+	defer close(t.done)
+
+	checkpoint := time.NewTicker(t.Options.CheckpointInterval)
+	defer checkpoint.Stop()
+	retention := time.NewTicker(retentionCheckInterval)
+	defer retention.Stop()
+
+	t.applyRetention()
+
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-checkpoint.C:
+			if err := t.Checkpoint(); err != nil {
+				log.Error().Err(err).Msg("tsdb checkpoint failed")
+			}
+		case <-retention.C:
+			t.applyRetention()
+		}
+	}
+}
+
+// applyRetention deletes chunks older than the retention period and series
+// left without any data
+func (t *TSDB) applyRetention() {
+	cutoff := time.Now().Add(-t.Options.Retention).UnixMilli()
+
+	var expired [][]byte
+	alive := make(map[uint64]struct{})
+	err := t.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		itr := txn.NewIterator(opts)
+		defer itr.Close()
+
+		prefix := []byte{chunkKeyPrefix}
+		for itr.Seek(prefix); itr.ValidForPrefix(prefix); itr.Next() {
+			ref, _, maxT := parseChunkKey(itr.Item().Key())
+			if maxT < cutoff {
+				expired = append(expired, itr.Item().KeyCopy(nil))
+			} else {
+				alive[ref] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed scanning chunks for retention")
+		return
+	}
+
+	t.appendMu.Lock()
+	t.mu.Lock()
+	for ref, s := range t.series {
+		s.mu.Lock()
+		empty := s.head == nil && len(s.flushing) == 0 && s.lastT < cutoff
+		s.mu.Unlock()
+		if _, ok := alive[ref]; ok || !empty {
+			continue
+		}
+
+		expired = append(expired, seriesKey(ref))
+		delete(t.series, ref)
+		hash := s.labels.Hash()
+		for i, other := range t.hashes[hash] {
+			if other == s {
+				t.hashes[hash] = append(t.hashes[hash][:i], t.hashes[hash][i+1:]...)
+				break
+			}
+		}
+		if len(t.hashes[hash]) == 0 {
+			delete(t.hashes, hash)
+		}
+	}
+	t.mu.Unlock()
+	t.appendMu.Unlock()
+
+	batch := t.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, key := range expired {
+		if err := batch.Delete(key); err != nil {
+			log.Error().Err(err).Msg("failed deleting expired data")
+			return
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		log.Error().Err(err).Msg("failed deleting expired data")
+		return
+	}
+
+	if len(expired) > 0 {
+		log.Info().Int("keys", len(expired)).Msg("deleted expired tsdb data")
+		if err := t.db.RunValueLogGC(0.5); err != nil && !errors.Is(err, badger.ErrNoRewrite) {
+			log.Warn().Err(err).Msg("value log gc failed")
+		}
+	}
+}
+
+// Close persists the head and closes the database
+func (t *TSDB) Close() error {
+	close(t.stopCh)
+	<-t.done
+
+	if err := t.Checkpoint(); err != nil {
+		log.Error().Err(err).Msg("final tsdb checkpoint failed")
+	}
+	if err := t.wal.close(); err != nil {
+		log.Error().Err(err).Msg("failed closing wal")
+	}
+
+	return t.db.Close()
+}
+
+const minTime = -1 << 63
+
+func seriesKey(ref uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = seriesKeyPrefix
+	binary.BigEndian.PutUint64(key[1:], ref)
+
+	return key
+}
+
+func seriesChunkPrefix(ref uint64) []byte {
+	prefix := make([]byte, 9)
+	prefix[0] = chunkKeyPrefix
+	binary.BigEndian.PutUint64(prefix[1:], ref)
+
+	return prefix
+}
+
+// chunkKey encodes timestamps with the sign bit flipped so that negative
+// timestamps still sort before positive ones
+func chunkKey(ref uint64, minT, maxT int64) []byte {
+	key := make([]byte, 25)
+	key[0] = chunkKeyPrefix
+	binary.BigEndian.PutUint64(key[1:], ref)
+	binary.BigEndian.PutUint64(key[9:], uint64(minT)^(1<<63))
+	binary.BigEndian.PutUint64(key[17:], uint64(maxT)^(1<<63))
+
+	return key
+}
+
+func parseChunkKey(key []byte) (ref uint64, minT, maxT int64) {
+	if len(key) != 25 {
+		return 0, 0, 0
+	}
+
+	return binary.BigEndian.Uint64(key[1:]),
+		int64(binary.BigEndian.Uint64(key[9:]) ^ (1 << 63)),
+		int64(binary.BigEndian.Uint64(key[17:]) ^ (1 << 63))
+}
+
+// compareLabels orders label sets lexicographically
+func compareLabels(a, b Labels) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,397 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// WAL record types
+const (
+	walRecordSeries  byte = 1
+	walRecordSamples byte = 2
+)
+
+// maxWALRecordSize guards replay against allocating for a corrupt length
+const maxWALRecordSize = 64 << 20
+
+var errWALCorrupt = errors.New("corrupt wal record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is a write-ahead log of series definitions and samples appended to the
+// head. It is split into numbered segment files; a checkpoint starts a new
+// segment and removes the older ones once their data is persisted.
+//
+// Each record is: type (1 byte), payload length (uvarint), payload, CRC32
+// of type and payload (4 bytes).
+type wal struct {
+	dir     string
+	segment int
+	file    *os.File
+	w       *bufio.Writer
+}
+
+type walSeries struct {
+	ref    uint64
+	labels Labels
+}
+
+type walSample struct {
+	ref uint64
+	t   int64
+	v   float64
+}
+
+func openWAL(dir string) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed creating wal dir: %w", err)
+	}
+
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	next := 0
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	w := &wal{dir: dir}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func walSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading wal dir: %w", err)
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		if n, err := strconv.Atoi(entry.Name()); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+func (w *wal) segmentPath(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", n))
+}
+
+func (w *wal) openSegment(n int) error {
+	file, err := os.OpenFile(w.segmentPath(n), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed opening wal segment: %w", err)
+	}
+
+	w.segment = n
+	w.file = file
+	w.w = bufio.NewWriter(file)
+
+	return nil
+}
+
+// replay reads every record of the segments before the current one, in
+// order. A torn or corrupt record ends the replay of its segment.
+func (w *wal) replay(onSeries func(walSeries), onSamples func([]walSample)) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range segments {
+		if n >= w.segment {
+			break
+		}
+		if err := w.replaySegment(n, onSeries, onSamples); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *wal) replaySegment(n int, onSeries func(walSeries), onSamples func([]walSample)) error {
+	file, err := os.Open(w.segmentPath(n))
+	if err != nil {
+		return fmt.Errorf("failed opening wal segment: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		typ, payload, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// the tail of the last write before a crash, nothing after it is usable
+			return nil
+		}
+
+		switch typ {
+		case walRecordSeries:
+			series, err := decodeWALSeries(payload)
+			if err != nil {
+				return nil
+			}
+			onSeries(series)
+		case walRecordSamples:
+			samples, err := decodeWALSamples(payload)
+			if err != nil {
+				return nil
+			}
+			onSamples(samples)
+		}
+	}
+}
+
+func readWALRecord(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > maxWALRecordSize {
+		return 0, nil, errWALCorrupt
+	}
+
+	buf := make([]byte, size+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, errWALCorrupt
+	}
+
+	payload := buf[:size]
+	crc := crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, payload)
+	if crc != binary.BigEndian.Uint32(buf[size:]) {
+		return 0, nil, errWALCorrupt
+	}
+
+	return typ, payload, nil
+}
+
+func (w *wal) writeRecord(typ byte, payload []byte) error {
+	var header [1 + binary.MaxVarintLen64]byte
+	header[0] = typ
+	n := binary.PutUvarint(header[1:], uint64(len(payload)))
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Update(crc32.Checksum([]byte{typ}, crcTable), crcTable, payload))
+
+	if _, err := w.w.Write(header[:1+n]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		return err
+	}
+	_, err := w.w.Write(crc[:])
+
+	return err
+}
+
+func (w *wal) logSeries(series []walSeries) error {
+	for _, s := range series {
+		if err := w.writeRecord(walRecordSeries, encodeWALSeries(s)); err != nil {
+			return fmt.Errorf("failed writing wal series: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// logSamples writes the samples and flushes them to the OS so that they
+// survive a crash of the agent process
+func (w *wal) logSamples(samples []walSample) error {
+	if err := w.writeRecord(walRecordSamples, encodeWALSamples(samples)); err != nil {
+		return fmt.Errorf("failed writing wal samples: %w", err)
+	}
+
+	return w.w.Flush()
+}
+
+// sync flushes buffered records and fsyncs the current segment
+func (w *wal) sync() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+// cut starts a new segment and returns the number of the first segment that
+// must be kept
+func (w *wal) cut() (int, error) {
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+
+	next := w.segment + 1
+	if err := w.openSegment(next); err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// truncate removes every segment before keep
+func (w *wal) truncate(keep int) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range segments {
+		if n >= keep {
+			break
+		}
+		if err := os.Remove(w.segmentPath(n)); err != nil {
+			return fmt.Errorf("failed removing wal segment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *wal) close() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	return w.file.Close()
+}
+
+func encodeWALSeries(s walSeries) []byte {
+	buf := binary.AppendUvarint(nil, s.ref)
+	buf = binary.AppendUvarint(buf, uint64(len(s.labels)))
+	for _, l := range s.labels {
+		buf = binary.AppendUvarint(buf, uint64(len(l.Name)))
+		buf = append(buf, l.Name...)
+		buf = binary.AppendUvarint(buf, uint64(len(l.Value)))
+		buf = append(buf, l.Value...)
+	}
+
+	return buf
+}
+
+func decodeWALSeries(buf []byte) (walSeries, error) {
+	d := decbuf{b: buf}
+	s := walSeries{ref: d.uvarint()}
+
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		s.labels = append(s.labels, Label{Name: d.string(), Value: d.string()})
+	}
+
+	return s, d.err
+}
+
+func encodeWALSamples(samples []walSample) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(samples)))
+	for _, s := range samples {
+		buf = binary.AppendUvarint(buf, s.ref)
+		buf = binary.AppendVarint(buf, s.t)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(s.v))
+	}
+
+	return buf
+}
+
+func decodeWALSamples(buf []byte) ([]walSample, error) {
+	d := decbuf{b: buf}
+
+	n := d.uvarint()
+	samples := make([]walSample, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		samples = append(samples, walSample{
+			ref: d.uvarint(),
+			t:   d.varint(),
+			v:   math.Float64frombits(d.uint64()),
+		})
+	}
+
+	return samples, d.err
+}
+
+// decbuf decodes a record payload, remembering the first error
+type decbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errWALCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *decbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errWALCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *decbuf) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = errWALCorrupt
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+
+	return v
+}
+
+func (d *decbuf) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errWALCorrupt
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+
+	return s
+}
@@ -1,9 +1,137 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
 	agent "github.com/jordanlumley/metricus/agent"
+	metricus "github.com/jordanlumley/metricus/sdk"
+	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	agent.StartAPI()
+	configPath := flag.String("config", "", "path to the agent YAML configuration file")
+	targets := flag.String("targets", "", "comma separated list of static scrape target hosts")
+	interval := flag.Int("interval", 2, "default scrape interval in seconds")
+	dockerDiscovery := flag.Bool("docker-discovery", true, "discover scrape targets from container labels")
+	dockerNetwork := flag.String("docker-network", "", "docker network used to resolve discovered container addresses")
+	storagePath := flag.String("storage-path", "data", "directory of the metrics database")
+	retention := flag.Duration("retention", agent.DefaultRetention, "how long stored samples are kept")
+	statsInterval := flag.Int("container-stats-interval", agent.DefaultContainerStatsIntervalSeconds, "how often container stats are stored, in seconds")
+	logCollection := flag.Bool("log-collection", false, "store the logs of running containers")
+	logLabels := flag.String("log-labels", "", "comma separated container labels, key or key=value, selecting the containers whose logs are stored")
+	logRetention := flag.Duration("log-retention", agent.DefaultLogRetention, "how long stored logs are kept")
+	fileDiscovery := flag.String("file-discovery", "", "comma separated list of JSON or YAML target files, globs allowed")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dockerService, err := metricus.NewDockerService()
+	if err != nil {
+		log.Fatal().Err(err).Msg("error creating docker service")
+	}
+	defer dockerService.Close()
+
+	storage, err := agent.OpenTSDB(agent.TSDBOptions{
+		Path:      *storagePath,
+		Retention: *retention,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("error opening metrics database")
+	}
+	defer storage.Close()
+
+	silences, err := agent.OpenSilences(filepath.Join(*storagePath, "silences.json"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading silences")
+	}
+
+	audit, err := agent.OpenAuditLog(filepath.Join(*storagePath, "audit.log"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading audit log")
+	}
+
+	var logs *agent.LogStore
+	if *logCollection {
+		logs, err = agent.OpenLogStore(agent.LogStoreOptions{
+			Path:      filepath.Join(*storagePath, "logs"),
+			Retention: *logRetention,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("error opening log store")
+		}
+		defer logs.Close()
+	}
+
+	opts := agent.Options{
+		Docker:                        dockerService,
+		Storage:                       storage,
+		Silences:                      silences,
+		Audit:                         audit,
+		Logs:                          logs,
+		LogCollection:                 agent.LogCollectorOptions{Labels: splitList(*logLabels)},
+		ContainerStatsIntervalSeconds: *statsInterval,
+	}
+	if *configPath != "" {
+		cfg, err := agent.LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error loading config")
+		}
+		opts.TargetRelabelConfigs = cfg.RelabelConfigs
+		opts.MetricRelabelConfigs = cfg.MetricRelabelConfigs
+		opts.RuleGroups = cfg.RuleGroups
+		opts.Route = cfg.Alerting.Route
+		opts.Control = cfg.Control
+		opts.LogMetrics = cfg.LogMetrics
+		if len(cfg.Alerting.Webhooks) > 0 {
+			opts.Notifier = agent.NewWebhookNotifier(cfg.Alerting.Webhooks)
+		}
+	}
+
+	for _, host := range splitList(*targets) {
+		opts.ScrapeTargets = append(opts.ScrapeTargets, agent.ScrapeOptions{
+			Host:            host,
+			IntervalSeconds: *interval,
+		})
+	}
+	if *dockerDiscovery {
+		opts.Discoverers = append(opts.Discoverers, agent.NewDockerDiscovery(dockerService, agent.DockerDiscoveryOptions{
+			Network:                *dockerNetwork,
+			DefaultIntervalSeconds: *interval,
+		}))
+	}
+
+	if files := splitList(*fileDiscovery); len(files) > 0 {
+		opts.Discoverers = append(opts.Discoverers, agent.NewFileDiscovery(agent.FileDiscoveryOptions{
+			Files:                  files,
+			DefaultIntervalSeconds: *interval,
+		}))
+	}
+
+	a := agent.New(opts)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		a.Start(ctx)
+	}()
+
+	agent.StartAPI(ctx, a)
+	<-stopped
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
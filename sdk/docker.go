@@ -1,16 +1,17 @@
 package metricus
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"strings"
 	"time"
 
-	"github.com/ahmetalpbalkan/dlog"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 )
 
@@ -31,87 +32,135 @@ func (d *DockerService) Close() error {
 	return d.client.Close()
 }
 
-func (d *DockerService) GetContainers(ctx context.Context) ([]types.Container, error) {
-	return d.client.ContainerList(ctx, container.ListOptions{All: true})
+// GetContainers returns all containers, stopped ones included, carrying all of
+// the given labels
+func (d *DockerService) GetContainers(ctx context.Context, labels ...string) ([]types.Container, error) {
+	return d.client.ContainerList(ctx, container.ListOptions{All: true, Filters: labelFilters(labels)})
 }
 
-func (d *DockerService) GetContainer(ctx context.Context, containerID string) (types.ContainerJSON, error) {
-	return d.client.ContainerInspect(ctx, containerID)
+// GetContainersByLabel returns running containers carrying all of the given
+// labels. A label given as "key" matches any value, "key=value" an exact one.
+func (d *DockerService) GetContainersByLabel(ctx context.Context, labels ...string) ([]types.Container, error) {
+	return d.client.ContainerList(ctx, container.ListOptions{Filters: labelFilters(labels)})
 }
 
-func (d *DockerService) GetLogs(ctx context.Context, containerID string) (string, error) {
-	out, err := d.client.ContainerLogs(ctx, containerID, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Tail:       "10",
-	})
-	if err != nil {
-		return "", err
-	}
-	defer out.Close()
-
-	p := make([]byte, 8)
-	_, err = out.Read(p)
-	if err != nil {
-		return "", err
-	}
-
-	logs, err := io.ReadAll(out)
-	if err != nil {
-		return "", err
+func labelFilters(labels []string) filters.Args {
+	args := filters.NewArgs()
+	for _, label := range labels {
+		args.Add("label", label)
 	}
 
-	fmt.Println(string(logs))
+	return args
+}
 
-	return string(logs), nil
+// EventFilter selects docker events. Empty fields match every event.
+type EventFilter struct {
+	// Types are object types such as container, image, network or volume
+	Types   []string
+	Actions []string
+	// Labels are "key" or "key=value" labels of the event's object
+	Labels []string
 }
 
-func (d *DockerService) StreamLogs(ctx context.Context, containerID string, stream chan []byte) error {
-	options := container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true, Tail: "15"}
-	out, err := d.client.ContainerLogs(ctx, containerID, options)
-	if err != nil {
-		return err
+// StreamEvents sends docker events matching filter until ctx is cancelled or
+// the event stream fails
+func (d *DockerService) StreamEvents(ctx context.Context, filter EventFilter, stream chan<- events.Message) error {
+	args := filters.NewArgs()
+	for _, t := range filter.Types {
+		args.Add("type", t)
+	}
+	for _, action := range filter.Actions {
+		args.Add("event", action)
+	}
+	for _, label := range filter.Labels {
+		args.Add("label", label)
 	}
-	defer out.Close()
 
-	r := dlog.NewReader(out)
-	s := bufio.NewScanner(r)
-	for s.Scan() {
+	messages, errs := d.client.Events(ctx, events.ListOptions{Filters: args})
+	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		default:
-			stream <- s.Bytes()
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case message := <-messages:
+			select {
+			case <-ctx.Done():
+				return nil
+			case stream <- message:
+			}
 		}
 	}
-	if err := s.Err(); err != nil {
-		return err
-	}
+}
+
+func (d *DockerService) GetContainer(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return d.client.ContainerInspect(ctx, containerID)
+}
 
-	return nil
+func (d *DockerService) StartContainer(ctx context.Context, containerID string) error {
+	return d.client.ContainerStart(ctx, containerID, container.StartOptions{})
+}
+
+// StopOptions control how a container is stopped or restarted. A nil Timeout
+// uses the container's stop timeout and an empty Signal its stop signal.
+type StopOptions struct {
+	// Timeout is how many seconds to wait before killing the container, -1
+	// waits forever
+	Timeout *int
+	Signal  string
+}
+
+func (d *DockerService) StopContainer(ctx context.Context, containerID string, opts StopOptions) error {
+	return d.client.ContainerStop(ctx, containerID, container.StopOptions{Timeout: opts.Timeout, Signal: opts.Signal})
+}
+
+func (d *DockerService) RestartContainer(ctx context.Context, containerID string, opts StopOptions) error {
+	return d.client.ContainerRestart(ctx, containerID, container.StopOptions{Timeout: opts.Timeout, Signal: opts.Signal})
+}
+
+func (d *DockerService) PauseContainer(ctx context.Context, containerID string) error {
+	return d.client.ContainerPause(ctx, containerID)
+}
+
+func (d *DockerService) UnpauseContainer(ctx context.Context, containerID string) error {
+	return d.client.ContainerUnpause(ctx, containerID)
+}
+
+// KillContainer sends signal to the container, SIGKILL when it is empty
+func (d *DockerService) KillContainer(ctx context.Context, containerID, signal string) error {
+	return d.client.ContainerKill(ctx, containerID, signal)
+}
+
+type RemoveOptions struct {
+	// Force kills a running container before removing it
+	Force         bool
+	RemoveVolumes bool
+}
+
+func (d *DockerService) RemoveContainer(ctx context.Context, containerID string, opts RemoveOptions) error {
+	return d.client.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: opts.Force, RemoveVolumes: opts.RemoveVolumes})
 }
 
 type Stats struct {
 	BlkioStats struct {
-		IoMergedRecursive       any `json:"io_merged_recursive"`
-		IoQueueRecursive        any `json:"io_queue_recursive"`
-		IoServiceBytesRecursive []struct {
-			Major int    `json:"major"`
-			Minor int    `json:"minor"`
-			Op    string `json:"op"`
-			Value int    `json:"value"`
-		} `json:"io_service_bytes_recursive"`
-		IoServiceTimeRecursive any `json:"io_service_time_recursive"`
-		IoServicedRecursive    any `json:"io_serviced_recursive"`
-		IoTimeRecursive        any `json:"io_time_recursive"`
-		IoWaitTimeRecursive    any `json:"io_wait_time_recursive"`
-		SectorsRecursive       any `json:"sectors_recursive"`
+		IoMergedRecursive       []BlkioStatEntry `json:"io_merged_recursive"`
+		IoQueueRecursive        []BlkioStatEntry `json:"io_queue_recursive"`
+		IoServiceBytesRecursive []BlkioStatEntry `json:"io_service_bytes_recursive"`
+		IoServiceTimeRecursive  []BlkioStatEntry `json:"io_service_time_recursive"`
+		IoServicedRecursive     []BlkioStatEntry `json:"io_serviced_recursive"`
+		IoTimeRecursive         []BlkioStatEntry `json:"io_time_recursive"`
+		IoWaitTimeRecursive     []BlkioStatEntry `json:"io_wait_time_recursive"`
+		SectorsRecursive        []BlkioStatEntry `json:"sectors_recursive"`
 	} `json:"blkio_stats"`
 	CPUStats struct {
 		CPUUsage struct {
-			TotalUsage        int64 `json:"total_usage"`
-			UsageInKernelmode int64 `json:"usage_in_kernelmode"`
-			UsageInUsermode   int64 `json:"usage_in_usermode"`
+			PercpuUsage       []int64 `json:"percpu_usage"`
+			TotalUsage        int64   `json:"total_usage"`
+			UsageInKernelmode int64   `json:"usage_in_kernelmode"`
+			UsageInUsermode   int64   `json:"usage_in_usermode"`
 		} `json:"cpu_usage"`
 		OnlineCpus     int   `json:"online_cpus"`
 		SystemCPUUsage int64 `json:"system_cpu_usage"`
@@ -152,6 +201,7 @@ type Stats struct {
 			Sock                  int `json:"sock"`
 			ThpCollapseAlloc      int `json:"thp_collapse_alloc"`
 			ThpFaultAlloc         int `json:"thp_fault_alloc"`
+			TotalInactiveFile     int `json:"total_inactive_file"`
 			Unevictable           int `json:"unevictable"`
 			WorkingsetActivate    int `json:"workingset_activate"`
 			WorkingsetNodereclaim int `json:"workingset_nodereclaim"`
@@ -159,29 +209,20 @@ type Stats struct {
 		} `json:"stats"`
 		Usage int `json:"usage"`
 	} `json:"memory_stats"`
-	Name     string `json:"name"`
-	Networks struct {
-		Eth0 struct {
-			RxBytes   int `json:"rx_bytes"`
-			RxDropped int `json:"rx_dropped"`
-			RxErrors  int `json:"rx_errors"`
-			RxPackets int `json:"rx_packets"`
-			TxBytes   int `json:"tx_bytes"`
-			TxDropped int `json:"tx_dropped"`
-			TxErrors  int `json:"tx_errors"`
-			TxPackets int `json:"tx_packets"`
-		} `json:"eth0"`
-	} `json:"networks"`
-	NumProcs  int `json:"num_procs"`
+	Name string `json:"name"`
+	// Networks are keyed by interface name, e.g. eth0
+	Networks  map[string]NetworkStats `json:"networks"`
+	NumProcs  int                     `json:"num_procs"`
 	PidsStats struct {
 		Current int `json:"current"`
 		Limit   int `json:"limit"`
 	} `json:"pids_stats"`
 	PrecpuStats struct {
 		CPUUsage struct {
-			TotalUsage        int64 `json:"total_usage"`
-			UsageInKernelmode int64 `json:"usage_in_kernelmode"`
-			UsageInUsermode   int64 `json:"usage_in_usermode"`
+			PercpuUsage       []int64 `json:"percpu_usage"`
+			TotalUsage        int64   `json:"total_usage"`
+			UsageInKernelmode int64   `json:"usage_in_kernelmode"`
+			UsageInUsermode   int64   `json:"usage_in_usermode"`
 		} `json:"cpu_usage"`
 		OnlineCpus     int   `json:"online_cpus"`
 		SystemCPUUsage int64 `json:"system_cpu_usage"`
@@ -212,26 +253,223 @@ func (d *DockerService) GetContainerMetrics(ctx context.Context, containerID str
 	return &statsObj, nil
 }
 
-func (d *DockerService) StreamContainerMetrics(ctx context.Context, containerID string, stream chan []byte) error {
-	stats, err := d.client.ContainerStats(ctx, containerID, true)
+// BlkioStatEntry is one per-device value of the block I/O stats. Only
+// cgroup v1 fills all lists, v2 reports io_service_bytes_recursive and
+// io_serviced_recursive.
+type BlkioStatEntry struct {
+	Major uint64 `json:"major"`
+	Minor uint64 `json:"minor"`
+	Op    string `json:"op"`
+	Value uint64 `json:"value"`
+}
+
+type NetworkStats struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxDropped uint64 `json:"rx_dropped"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxDropped uint64 `json:"tx_dropped"`
+	TxErrors  uint64 `json:"tx_errors"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+// ContainerStats are the values derived from the docker stats of a
+// container. Rates are per second between two consecutive reads and zero when
+// only one read is known.
+type ContainerStats struct {
+	ID                       string    `json:"id"`
+	Name                     string    `json:"name"`
+	Read                     time.Time `json:"read"`
+	CPUPercent               float64   `json:"cpuPercent"`
+	OnlineCPUs               int       `json:"onlineCpus"`
+	MemoryUsageBytes         int64     `json:"memoryUsageBytes"`
+	MemoryInactiveFileBytes  int64     `json:"memoryInactiveFileBytes"`
+	MemoryLimitBytes         int64     `json:"memoryLimitBytes"`
+	MemoryPercent            float64   `json:"memoryPercent"`
+	BlockReadBytes           int64     `json:"blockReadBytes"`
+	BlockWriteBytes          int64     `json:"blockWriteBytes"`
+	BlockReadBytesPerSecond  float64   `json:"blockReadBytesPerSecond"`
+	BlockWriteBytesPerSecond float64   `json:"blockWriteBytesPerSecond"`
+	NetworkRxBytes           int64     `json:"networkRxBytes"`
+	NetworkTxBytes           int64     `json:"networkTxBytes"`
+	NetworkRxBytesPerSecond  float64   `json:"networkRxBytesPerSecond"`
+	NetworkTxBytesPerSecond  float64   `json:"networkTxBytesPerSecond"`
+	PIDs                     int       `json:"pids"`
+	// Networks are the per-interface values, the Network fields their totals
+	Networks map[string]InterfaceStats `json:"networks"`
+}
+
+type InterfaceStats struct {
+	RxBytes          int64   `json:"rxBytes"`
+	TxBytes          int64   `json:"txBytes"`
+	RxPackets        int64   `json:"rxPackets"`
+	TxPackets        int64   `json:"txPackets"`
+	RxErrors         int64   `json:"rxErrors"`
+	TxErrors         int64   `json:"txErrors"`
+	RxDropped        int64   `json:"rxDropped"`
+	TxDropped        int64   `json:"txDropped"`
+	RxBytesPerSecond float64 `json:"rxBytesPerSecond"`
+	TxBytesPerSecond float64 `json:"txBytesPerSecond"`
+}
+
+// NewContainerStats derives the stats of cur. prev is the read before cur
+// and may be nil.
+func NewContainerStats(cur, prev *Stats) ContainerStats {
+	cs := ContainerStats{
+		ID:               cur.ID,
+		Name:             strings.TrimPrefix(cur.Name, "/"),
+		Read:             cur.Read,
+		CPUPercent:       cur.cpuPercent(),
+		OnlineCPUs:       cur.onlineCPUs(),
+		MemoryLimitBytes: cur.MemoryStats.Limit,
+		PIDs:             cur.PidsStats.Current,
+	}
+
+	cs.MemoryUsageBytes, cs.MemoryInactiveFileBytes = cur.memoryUsage()
+	if cs.MemoryLimitBytes > 0 {
+		cs.MemoryPercent = float64(cs.MemoryUsageBytes) / float64(cs.MemoryLimitBytes) * 100
+	}
+	cs.BlockReadBytes, cs.BlockWriteBytes = cur.blockIO()
+
+	cs.Networks = make(map[string]InterfaceStats, len(cur.Networks))
+	for name, n := range cur.Networks {
+		cs.Networks[name] = InterfaceStats{
+			RxBytes:   int64(n.RxBytes),
+			TxBytes:   int64(n.TxBytes),
+			RxPackets: int64(n.RxPackets),
+			TxPackets: int64(n.TxPackets),
+			RxErrors:  int64(n.RxErrors),
+			TxErrors:  int64(n.TxErrors),
+			RxDropped: int64(n.RxDropped),
+			TxDropped: int64(n.TxDropped),
+		}
+		cs.NetworkRxBytes += int64(n.RxBytes)
+		cs.NetworkTxBytes += int64(n.TxBytes)
+	}
+
+	if prev == nil {
+		return cs
+	}
+	seconds := cur.Read.Sub(prev.Read).Seconds()
+	if seconds <= 0 {
+		return cs
+	}
+
+	rate := func(cur, prev int64) float64 {
+		if cur < prev {
+			// the counter was reset, e.g. by a container restart
+			return 0
+		}
+		return float64(cur-prev) / seconds
+	}
+	prevRead, prevWrite := prev.blockIO()
+	cs.BlockReadBytesPerSecond = rate(cs.BlockReadBytes, prevRead)
+	cs.BlockWriteBytesPerSecond = rate(cs.BlockWriteBytes, prevWrite)
+	for name, n := range cs.Networks {
+		// an interface attached since the previous read has no rate yet
+		p, ok := prev.Networks[name]
+		if !ok {
+			continue
+		}
+		n.RxBytesPerSecond = rate(n.RxBytes, int64(p.RxBytes))
+		n.TxBytesPerSecond = rate(n.TxBytes, int64(p.TxBytes))
+		cs.Networks[name] = n
+
+		cs.NetworkRxBytesPerSecond += n.RxBytesPerSecond
+		cs.NetworkTxBytesPerSecond += n.TxBytesPerSecond
+	}
+
+	return cs
+}
+
+func (s *Stats) onlineCPUs() int {
+	if s.CPUStats.OnlineCpus > 0 {
+		return s.CPUStats.OnlineCpus
+	}
+
+	return len(s.CPUStats.CPUUsage.PercpuUsage)
+}
+
+// cpuPercent is the share of the host's CPU time used by the container since
+// the previous read, where 100% is one full CPU
+func (s *Stats) cpuPercent() float64 {
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage - s.PrecpuStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemCPUUsage - s.PrecpuStats.SystemCPUUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	return cpuDelta / systemDelta * float64(s.onlineCPUs()) * 100
+}
+
+// memoryUsage returns the memory used without the inactive file pages, which
+// the kernel can reclaim first, as docker stats does, and those pages
+func (s *Stats) memoryUsage() (usage, inactiveFile int64) {
+	// cgroup v1 reports total_inactive_file, v2 inactive_file
+	inactiveFile = int64(s.MemoryStats.Stats.TotalInactiveFile)
+	if inactiveFile == 0 {
+		inactiveFile = int64(s.MemoryStats.Stats.InactiveFile)
+	}
+
+	usage = int64(s.MemoryStats.Usage)
+	if inactiveFile > usage {
+		return usage, inactiveFile
+	}
+
+	return usage - inactiveFile, inactiveFile
+}
+
+func (s *Stats) blockIO() (read, write int64) {
+	for _, entry := range s.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += int64(entry.Value)
+		case "write":
+			write += int64(entry.Value)
+		}
+	}
+
+	return read, write
+}
+
+// GetContainerStats reads the stats of the container once and derives them.
+// The CPU percentage comes from the precpu_stats of that read, the block I/O
+// and network rates need two reads and are only set by StreamContainerStats.
+func (d *DockerService) GetContainerStats(ctx context.Context, containerID string) (ContainerStats, error) {
+	stats, err := d.GetContainerMetrics(ctx, containerID)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+
+	return NewContainerStats(stats, nil), nil
+}
+
+// StreamContainerStats sends the derived stats of the container, about once
+// a second, until ctx is cancelled or the container stops
+func (d *DockerService) StreamContainerStats(ctx context.Context, containerID string, stream chan<- ContainerStats) error {
+	resp, err := d.client.ContainerStats(ctx, containerID, true)
 	if err != nil {
 		return err
 	}
-	defer stats.Body.Close()
+	defer resp.Body.Close()
 
-	reader := bufio.NewReader(stats.Body)
+	dec := json.NewDecoder(resp.Body)
+	var prev *Stats
 	for {
+		var cur Stats
+		if err := dec.Decode(&cur); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
 		select {
 		case <-ctx.Done():
 			return nil
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil && err != io.EOF {
-				return err
-			}
-			if len(line) > 0 {
-				stream <- line
-			}
+		case stream <- NewContainerStats(&cur, prev):
 		}
+		prev = &cur
 	}
 }
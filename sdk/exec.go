@@ -0,0 +1,112 @@
+package metricus
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+type ExecOptions struct {
+	Cmd        []string
+	Tty        bool
+	User       string
+	WorkingDir string
+	Env        []string
+	// Height and Width are the initial TTY size, zero keeps docker's default
+	Height uint
+	Width  uint
+}
+
+// ExecSession is a command running in a container with its stdin, stdout and
+// stderr attached
+type ExecSession struct {
+	ID string
+
+	client *DockerService
+	tty    bool
+	conn   types.HijackedResponse
+}
+
+// Exec starts a command in a running container and attaches to it. The
+// session must be closed.
+func (d *DockerService) Exec(ctx context.Context, containerID string, opts ExecOptions) (*ExecSession, error) {
+	if len(opts.Cmd) == 0 {
+		return nil, fmt.Errorf("exec command is required")
+	}
+
+	var size *[2]uint
+	if opts.Height > 0 && opts.Width > 0 {
+		size = &[2]uint{opts.Height, opts.Width}
+	}
+
+	created, err := d.client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          opts.Cmd,
+		Tty:          opts.Tty,
+		User:         opts.User,
+		WorkingDir:   opts.WorkingDir,
+		Env:          opts.Env,
+		ConsoleSize:  size,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.client.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{Tty: opts.Tty, ConsoleSize: size})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExecSession{ID: created.ID, client: d, tty: opts.Tty, conn: conn}, nil
+}
+
+// Write sends p to the command's stdin
+func (s *ExecSession) Write(p []byte) (int, error) {
+	return s.conn.Conn.Write(p)
+}
+
+// CloseStdin closes the command's stdin, leaving its output attached
+func (s *ExecSession) CloseStdin() error {
+	return s.conn.CloseWrite()
+}
+
+// Copy writes the command's output until it exits. With a TTY stdout and
+// stderr are merged and everything is written to stdout.
+func (s *ExecSession) Copy(stdout, stderr io.Writer) error {
+	if s.tty {
+		_, err := io.Copy(stdout, s.conn.Reader)
+		return err
+	}
+
+	_, err := stdcopy.StdCopy(stdout, stderr, s.conn.Reader)
+	return err
+}
+
+// Resize changes the TTY size of the command
+func (s *ExecSession) Resize(ctx context.Context, height, width uint) error {
+	return s.client.client.ContainerExecResize(ctx, s.ID, container.ResizeOptions{Height: height, Width: width})
+}
+
+// ExitCode returns the command's exit code, running is true while it has not
+// exited
+func (s *ExecSession) ExitCode(ctx context.Context) (code int, running bool, err error) {
+	inspect, err := s.client.client.ContainerExecInspect(ctx, s.ID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return inspect.ExitCode, inspect.Running, nil
+}
+
+// Close detaches from the command. Closing the connection hangs up a TTY and
+// closes the stdin of other commands, which ends interactive shells.
+func (s *ExecSession) Close() error {
+	s.conn.Close()
+	return nil
+}
@@ -0,0 +1,188 @@
+package metricus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// LogsOptions select the lines of a container's logs. Since and Until are
+// RFC 3339 times, unix timestamps or durations before now such as 10m.
+type LogsOptions struct {
+	Since string
+	Until string
+	// Tail is the number of lines from the end of the logs, or "all"
+	Tail   string
+	Stdout bool
+	Stderr bool
+	// Timestamps sets LogLine.Timestamp
+	Timestamps bool
+}
+
+// LogLine is one line of a container's output
+type LogLine struct {
+	Stream    string    `json:"stream"`
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line"`
+}
+
+// MarshalJSON leaves out the timestamp of lines read without timestamps
+func (l LogLine) MarshalJSON() ([]byte, error) {
+	type logLine LogLine
+	if l.Timestamp.IsZero() {
+		return json.Marshal(struct {
+			logLine
+			Timestamp *time.Time `json:"timestamp,omitempty"`
+		}{logLine: logLine(l)})
+	}
+
+	return json.Marshal(logLine(l))
+}
+
+// GetLogs returns the lines of the container's logs selected by opts
+func (d *DockerService) GetLogs(ctx context.Context, containerID string, opts LogsOptions) ([]LogLine, error) {
+	lines := []LogLine{}
+	err := d.ScanLogs(ctx, containerID, opts, func(line LogLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+
+	return lines, err
+}
+
+// ScanLogs calls fn with each line selected by opts without keeping them,
+// stopping at the first error fn returns
+func (d *DockerService) ScanLogs(ctx context.Context, containerID string, opts LogsOptions, fn func(LogLine) error) error {
+	return d.readLogs(ctx, containerID, opts, false, fn)
+}
+
+// StreamLogs sends the lines selected by opts and then follows the logs until
+// ctx is cancelled or the container stops
+func (d *DockerService) StreamLogs(ctx context.Context, containerID string, opts LogsOptions, stream chan<- LogLine) error {
+	err := d.readLogs(ctx, containerID, opts, true, func(line LogLine) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case stream <- line:
+			return nil
+		}
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+func (d *DockerService) readLogs(ctx context.Context, containerID string, opts LogsOptions, follow bool, emit func(LogLine) error) error {
+	inspect, err := d.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	out, err := d.client.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: opts.Stdout,
+		ShowStderr: opts.Stderr,
+		Since:      opts.Since,
+		Until:      opts.Until,
+		Tail:       opts.Tail,
+		Follow:     follow,
+		Timestamps: opts.Timestamps,
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return demuxLogs(out, inspect.Config != nil && inspect.Config.Tty, func(stream string, line []byte) error {
+		if !opts.Timestamps {
+			return emit(LogLine{Stream: stream, Line: string(line)})
+		}
+		return emit(parseLogLine(stream, line))
+	})
+}
+
+// demuxLogs splits a log stream into lines. Without a TTY docker multiplexes
+// stdout and stderr into frames, which stdcopy separates. A line may span
+// several frames.
+func demuxLogs(r io.Reader, tty bool, emit func(stream string, line []byte) error) error {
+	stdout := &lineWriter{stream: StreamStdout, emit: emit}
+	stderr := &lineWriter{stream: StreamStderr, emit: emit}
+
+	var err error
+	if tty {
+		_, err = io.Copy(stdout, r)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := stdout.flush(); err != nil {
+		return err
+	}
+	return stderr.flush()
+}
+
+// lineWriter calls emit with every complete line written to it and keeps the
+// rest until the next write or flush
+type lineWriter struct {
+	stream  string
+	emit    func(stream string, line []byte) error
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	buf := append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.emit(w.stream, bytes.TrimRight(buf[:i], "\r")); err != nil {
+			return 0, err
+		}
+		buf = buf[i+1:]
+	}
+	w.partial = append(w.partial[:0], buf...)
+
+	return len(p), nil
+}
+
+// flush emits the last line when the stream did not end with a newline
+func (w *lineWriter) flush() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+	line := w.partial
+	w.partial = nil
+
+	return w.emit(w.stream, bytes.TrimRight(line, "\r"))
+}
+
+// parseLogLine splits the timestamp docker prefixes lines with from the line
+func parseLogLine(stream string, line []byte) LogLine {
+	l := LogLine{Stream: stream, Line: string(line)}
+
+	ts, rest, ok := bytes.Cut(line, []byte{' '})
+	if !ok {
+		// an empty line is only its timestamp
+		ts, rest = line, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, string(ts)); err == nil {
+		l.Timestamp, l.Line = t, string(rest)
+	}
+
+	return l
+}